@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"lambdaroach/shared"
+	"log"
+)
+
+// diffStrings prints the entries of a list like env or hosts that were removed or added
+func diffStrings(what string, from, to []string) bool {
+	old := map[string]bool{}
+	for _, entry := range from {
+		old[entry] = true
+	}
+	changed := false
+	for _, entry := range to {
+		if old[entry] {
+			delete(old, entry)
+			continue
+		}
+		fmt.Printf("%s: + %s\n", what, entry)
+		changed = true
+	}
+	for _, entry := range from {
+		if old[entry] {
+			fmt.Printf("%s: - %s\n", what, entry)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// diff handles `roachctl diff`, showing what a deploy would change compared to the active version on the server
+func diff(config shared.Config, args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Parse(args)
+
+	app, err := config.AppMessage("none")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if app.TLS && *apppath == "." {
+		skipfiles[*config.Certificate] = true
+		skipfiles[*config.PrivateKey] = true
+	}
+	manifest, _ := buildManifest(*apppath)
+
+	conn, c, hello := connect()
+	defer conn.Close()
+	if !hello.Has(shared.CapDiff) {
+		log.Fatal("server does not support diff, upgrade lambdaroach")
+	}
+	err = c.WriteJSON(shared.DiffMessage{Op: shared.OpDiff, Name: config.Name})
+	if err != nil {
+		log.Fatal(err)
+	}
+	readStatus(c)
+	var deployed shared.Deployed
+	err = c.ReadJSON(&deployed)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print("comparing with app: ", config.Name, " version: ", deployed.Version)
+	added, removed, changed := shared.DiffManifests(deployed.Manifest, manifest)
+	for _, name := range added {
+		fmt.Println("+ " + name)
+	}
+	for _, name := range removed {
+		fmt.Println("- " + name)
+	}
+	for _, name := range changed {
+		fmt.Println("M " + name)
+	}
+
+	configChanged := diffStrings("hosts", deployed.Hosts, app.Hosts)
+	configChanged = diffStrings("env", deployed.Env, app.Env) || configChanged
+	paths := app.Paths
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	configChanged = diffStrings("paths", deployed.Paths, paths) || configChanged
+	if deployed.StripPath != app.StripPath {
+		fmt.Printf("strippath: %v -> %v\n", deployed.StripPath, app.StripPath)
+		configChanged = true
+	}
+	if deployed.Command != app.Command {
+		fmt.Printf("command: %q -> %q\n", deployed.Command, app.Command)
+		configChanged = true
+	}
+	// compared as json, which leaves out empty lists
+	from, _ := json.Marshal(deployed.Rules)
+	to, _ := json.Marshal(app.Rules)
+	if string(from) != string(to) {
+		fmt.Println("rules: changed")
+		configChanged = true
+	}
+	from, _ = json.Marshal(deployed.Static)
+	to, _ = json.Marshal(app.Static)
+	if string(from) != string(to) {
+		fmt.Println("static: changed")
+		configChanged = true
+	}
+	from, _ = json.Marshal(deployed.Compress)
+	to, _ = json.Marshal(app.Compress)
+	if string(from) != string(to) {
+		fmt.Println("compress: changed")
+		configChanged = true
+	}
+	if deployed.HTTPSOnly != app.HTTPSOnly {
+		fmt.Printf("httpsonly: %v -> %v\n", deployed.HTTPSOnly, app.HTTPSOnly)
+		configChanged = true
+	}
+
+	if len(added)+len(removed)+len(changed) == 0 && !configChanged {
+		log.Print("no changes, digest: ", manifest.Digest)
+		return
+	}
+	log.Print("files added: ", len(added), ", removed: ", len(removed), ", changed: ", len(changed), ", config changed: ", configChanged)
+}
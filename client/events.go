@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"lambdaroach/shared"
+	"log"
+)
+
+func printEvent(event shared.Event) {
+	app := "-"
+	if event.App != "" {
+		app = fmt.Sprintf("%s@%d", event.App, event.Version)
+	}
+	instance := "-"
+	if event.Instance != 0 {
+		instance = fmt.Sprintf("%d", event.Instance)
+	}
+	fmt.Printf("%s %s %s %s %s\n", event.Time.Local().Format("2006-01-02 15:04:05"), event.Type, app, instance, event.Msg)
+}
+
+// events handles `roachctl events [-all] [-type type] [-since 1h] [-n events] [app]`
+func events(args []string) {
+	flags := flag.NewFlagSet("events", flag.ExitOnError)
+	all := flags.Bool("all", false, "show the events of all apps")
+	kind := flags.String("type", "", "only show events of this type, like crashed or deployed")
+	since := flags.String("since", "", "only show events since a duration ago like 1h, or a time like 2006-01-02T15:04:05Z")
+	limit := flags.Int("n", 0, "only show the last n events")
+	flags.Parse(args)
+
+	msg := shared.EventsMessage{
+		Op:    shared.OpEvents,
+		Type:  *kind,
+		Since: parseTime(*since),
+		Limit: *limit,
+	}
+	if !*all {
+		msg.Name = appName(flags.Arg(0))
+	} else if *host == "" {
+		loadConfig()
+	}
+
+	conn, c, _ := connect()
+	defer conn.Close()
+	err := c.WriteJSON(msg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	readStatus(c)
+
+	for {
+		var event shared.Event
+		err = c.ReadJSON(&event)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if event.Type == "" {
+			return
+		}
+		printEvent(event)
+	}
+}
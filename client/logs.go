@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"lambdaroach/shared"
+	"log"
+	"time"
+)
+
+// parseTime parses a flag like -since using shared.ParseTime
+func parseTime(s string) time.Time {
+	t, err := shared.ParseTime(s)
+	if err != nil {
+		log.Fatal("bad time, use a duration like 10m or a time like 2006-01-02T15:04:05Z: ", s)
+	}
+	return t
+}
+
+func printLogLine(line shared.LogLine) {
+	fmt.Printf("%s %s@%d %d %s: %s\n", line.Time.Local().Format("2006-01-02 15:04:05.000"), line.App, line.Version, line.Instance, line.Stream, line.Line)
+}
+
+// logs handles `roachctl logs [-f [-access]] [-stream stdout|stderr] [-since 10m] [-until time] [-n lines] [app]`
+func logs(args []string) {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	stream := flags.String("stream", "", "only show lines from stdout or stderr")
+	since := flags.String("since", "", "only show lines since a duration ago like 10m, or a time like 2006-01-02T15:04:05Z")
+	until := flags.String("until", "", "only show lines until a duration ago like 10m, or a time like 2006-01-02T15:04:05Z")
+	limit := flags.Int("n", 0, "only show the last n lines")
+	follow := flags.Bool("f", false, "keep showing new lines until interrupted")
+	access := flags.Bool("access", false, "when following, also show the access log of the app")
+	flags.Parse(args)
+
+	msg := shared.LogsMessage{
+		Op:     shared.OpLogs,
+		Name:   appName(flags.Arg(0)),
+		Since:  parseTime(*since),
+		Until:  parseTime(*until),
+		Stream: *stream,
+		Limit:  *limit,
+		Follow: *follow,
+		Access: *access,
+	}
+
+	conn, c, _ := connect()
+	defer conn.Close()
+	err := c.WriteJSON(msg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	readStatus(c)
+
+	for {
+		var line shared.LogLine
+		err = c.ReadJSON(&line)
+		if err == io.EOF && *follow {
+			log.Print("connection closed")
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if line.App == "" {
+			return
+		}
+		printLogLine(line)
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -22,54 +25,119 @@ var host = flag.String("h", "", "[ssh:]host to connect with, default is ssh:app.
 var port = flag.String("p", "8888", "port to connect, normal port is 8888")
 var apppath = flag.String("d", ".", "application path, default is the current directory")
 var appconfig = flag.String("f", "", "app config file, default is appdir/lambda.config.json or ./lambda.config.json")
+var archive = flag.String("archive", "", "deploy the files in a tar, tar.gz, tar.zst or zip archive instead of the application path")
+var full = flag.Bool("full", false, "upload all files, instead of only the files the server does not have yet")
+var listfiles = flag.Bool("list-files", false, "list the files that would be uploaded, without uploading")
 var skipfiles = map[string]bool{}
+var configIgnore = shared.Ignore{}
+var gitignore = false
 
-// Config for lambda.config.json
-type Config struct {
-	Name        string   `json:"name"`        // name of site, must be unique
-	Hostname    string   `json:"hostname"`    // hostname of site
-	Command     string   `json:"command"`     // command to run, null or "" to serve as static site
-	Env         []string `json:"env"`         // environment variables added to command
-	Certificate *string  `json:"certificate"` // to configure tls, the public key
-	PrivateKey  *string  `json:"privatekey"`  // to configure tls, the private key
-	LetsEncrypt *string  `json:"letsencrypt"` // to configure tls using letsencrypt, your email
-	HTTPSOnly   bool     `json:"httpsonly"`   // if site opened using http, redirect to https immediately
+// sendArchive streams an archive of the app files, with its sha256, the server unpacks it
+func sendArchive(path string, c *shared.Conn) (int64, error) {
+	hash, err := shared.HashFile(path)
+	if err != nil {
+		return 0, err
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	err = c.WriteJSON(shared.FileMessage{Size: int(stat.Size()), Archive: true, Hash: hash})
+	if err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	written, err := io.Copy(c, io.TeeReader(in, h))
+	if err == nil && (written != stat.Size() || hex.EncodeToString(h.Sum(nil)) != hash) {
+		err = errors.New("archive changed while uploading: " + path)
+	}
+	return written, err
 }
 
-func sendFile(path, name string, conn io.ReadWriter) (int, error) {
-	// TODO stream file instead ...
-	bytes, err := ioutil.ReadFile(path)
+// streamFile writes the contents of file from offset, without reading it into memory
+func streamFile(file string, offset, size int64, c *shared.Conn) (int64, error) {
+	in, err := os.Open(file)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	file := shared.FileMessage{Name: name, Size: len(bytes)}
-	err = shared.WriteJSON0(conn, file)
-	if err != nil {
-		log.Fatal(err)
+	defer in.Close()
+	if _, err := in.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
 	}
+	written, err := io.Copy(c, io.LimitReader(in, size-offset))
+	if err == nil && written != size-offset {
+		err = errors.New("file changed while uploading: " + file)
+	}
+	return written, err
+}
 
-	written, err := conn.Write(bytes)
+// sendFile sends a file, with the sha256 of its contents, it returns the size and the hash
+func sendFile(path, name string, c *shared.Conn) (int64, string, error) {
+	stat, err := os.Stat(path)
 	if err != nil {
-		log.Fatal(err)
+		return 0, "", err
+	}
+	hash, err := shared.HashFile(path)
+	if err != nil {
+		return 0, "", err
+	}
+	err = c.WriteJSON(shared.FileMessage{Name: name, Size: int(stat.Size()), Hash: hash})
+	if err != nil {
+		return 0, "", err
+	}
+	written, err := streamFile(path, 0, stat.Size(), c)
+	return written, hash, err
+}
+
+// hiddenFiles are not uploaded, unless included again by an ignore file or the config
+var hiddenFiles, _ = shared.ParseIgnore("", []string{".*"})
+
+// readIgnore returns the patterns of the ignore files in dir, which is sub in the app
+func readIgnore(dir, sub string) shared.Ignore {
+	names := []string{shared.IgnoreFile}
+	if gitignore {
+		names = []string{".gitignore", shared.IgnoreFile}
 	}
-	if written != len(bytes) {
-		log.Fatal("unable to write all bytes??")
+	rules := shared.Ignore{}
+	for _, name := range names {
+		bytes, err := ioutil.ReadFile(path.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		ignore, err := shared.ParseIgnore(sub, strings.Split(string(bytes), "\n"))
+		if err != nil {
+			log.Fatal("unable to parse: ", path.Join(dir, name), " got: ", err)
+		}
+		rules = append(rules, ignore...)
 	}
-	return written, nil
+	return rules
+}
+
+// walkFiles calls fn for the files and directories of the app in dir, skipping hidden and ignored files, links are
+// followed
+func walkFiles(dir string, sub string, fn func(fullpath, name string, isdir bool)) {
+	walkDir(dir, sub, hiddenFiles, fn)
 }
 
-func sendFiles(dir string, sub string, conn io.ReadWriter) (filecount int, bytecount int64) {
+// walkDir walks dir with the patterns of the ignore files of its parents, the patterns of deeper ignore files and of
+// the config come later, so they win
+func walkDir(dir string, sub string, parents shared.Ignore, fn func(fullpath, name string, isdir bool)) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	inherited := append(parents[:len(parents):len(parents)], readIgnore(dir, sub)...)
+	rules := append(inherited[:len(inherited):len(inherited)], configIgnore...)
 
 	for _, file := range files {
-		if file.Name()[0] == '.' {
-			//log.Print("skipping hidden file: ", file.Name())
-			continue
-		}
-
 		if sub == "" {
 			if _, ok := skipfiles[file.Name()]; ok {
 				continue
@@ -94,31 +162,128 @@ func sendFiles(dir string, sub string, conn io.ReadWriter) (filecount int, bytec
 			}
 		}
 
+		name := path.Join(sub, file.Name())
+		if rules.Match(name, isdir) {
+			continue
+		}
 		if isdir {
-			ndir := path.Join(dir, file.Name())
-			nsub := path.Join(sub, file.Name())
-			file := shared.FileMessage{Name: nsub + "/"}
-			err = shared.WriteJSON0(conn, file)
-			if err != nil {
-				log.Fatal(err)
-			}
+			fn(fullpath, name+"/", true)
 			// recurse
-			fc, bc := sendFiles(ndir, nsub, conn)
-			filecount += fc
-			bytecount += bc
+			walkDir(fullpath, name, inherited, fn)
 			continue
 		}
 		if !isfile {
 			log.Print("skipping non file: ", file.Name())
 			continue
 		}
+		fn(fullpath, name, false)
+	}
+}
+
+// listFiles prints the files that would be uploaded
+func listFiles(dir string) {
+	var filecount = 0
+	var bytecount = int64(0)
+	walkFiles(dir, "", func(fullpath, name string, isdir bool) {
+		if isdir {
+			return
+		}
+		stat, err := os.Stat(fullpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(name)
+		filecount++
+		bytecount += stat.Size()
+	})
+	log.Print("files: ", filecount, ", total bytes: ", bytecount)
+}
 
-		written, err := sendFile(path.Join(dir, file.Name()), path.Join(sub, file.Name()), conn)
+// sendFiles sends all files, and returns the digest of the files sent
+func sendFiles(dir string, sub string, c *shared.Conn) (filecount int, bytecount int64, digest string) {
+	sent := []shared.ManifestFile{}
+	walkFiles(dir, sub, func(fullpath, name string, isdir bool) {
+		if isdir {
+			err := c.WriteJSON(shared.FileMessage{Name: name})
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		written, hash, err := sendFile(fullpath, name, c)
 		if err != nil {
 			log.Fatal(err)
 		}
+		sent = append(sent, shared.ManifestFile{Name: name, Hash: hash})
 		filecount++
-		bytecount += int64(written)
+		bytecount += written
+	})
+	digest = shared.Digest(sent)
+	return
+}
+
+// buildManifest returns the Manifest of the files in dir, and the path of the files by hash
+func buildManifest(dir string) (shared.Manifest, map[string]string) {
+	manifest := shared.Manifest{Files: []shared.ManifestFile{}}
+	paths := map[string]string{}
+	walkFiles(dir, "", func(fullpath, name string, isdir bool) {
+		stat, err := os.Stat(fullpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		file := shared.ManifestFile{Name: name, Perm: int(stat.Mode().Perm())}
+		if !isdir {
+			file.Size = stat.Size()
+			file.Hash, err = shared.HashFile(fullpath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			paths[file.Hash] = fullpath
+		}
+		manifest.Files = append(manifest.Files, file)
+	})
+	manifest.Digest = shared.Digest(manifest.Files)
+	return manifest, paths
+}
+
+// sendManifest sends the hashes of all files, and then only the files the server asks for
+func sendManifest(dir string, c *shared.Conn) (filecount int, bytecount int64, digest string) {
+	manifest, paths := buildManifest(dir)
+	digest = manifest.Digest
+	err := c.WriteJSON(manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var missing shared.Missing
+	err = c.ReadJSON(&missing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Print("files: ", len(manifest.Files), ", server is missing: ", len(missing.Hashes))
+	for _, hash := range missing.Hashes {
+		fullpath, ok := paths[hash]
+		if !ok {
+			log.Fatal("server asked for unknown file: ", hash)
+		}
+		stat, err := os.Stat(fullpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		offset := missing.Partial[hash]
+		if offset > 0 {
+			log.Print("resuming: ", fullpath, " at: ", offset)
+		}
+		err = c.WriteJSON(shared.FileMessage{Hash: hash, Size: int(stat.Size()), Offset: offset})
+		if err != nil {
+			log.Fatal(err)
+		}
+		written, err := streamFile(fullpath, offset, stat.Size(), c)
+		if err != nil {
+			log.Fatal("upload interrupted, run again to resume: ", err)
+		}
+		filecount++
+		bytecount += written
 	}
 	return
 }
@@ -199,27 +364,21 @@ func dialSSH(host string) (io.ReadWriteCloser, error) {
 	return combinedPipe{stdin, stdout}, nil
 }
 
-func main() {
-	log.SetFlags(log.Flags() | log.Lshortfile)
-	log.SetPrefix(fmt.Sprintf("%s ", path.Base(os.Args[0])))
-	flag.Parse()
-
+// loadConfig reads lambda.config.json and fills in the default host
+func loadConfig() shared.Config {
 	if apppath == nil || *apppath == "" || *appconfig == "./" {
 		*apppath = "."
 	}
 	var appconfig1 = *appconfig
 	var appconfig2 = ""
-	if appconfig1 == "" && *apppath != "." {
+	if appconfig1 == "" {
 		appconfig1 = path.Join(*apppath, "lambda.config.json")
-		appconfig2 = "lambda.config.json"
+		if *apppath != "." {
+			appconfig2 = "lambda.config.json"
+		}
 		skipfiles["lambda.config.json"] = true
 	}
 
-	version := flag.Arg(0)
-	if version == "" {
-		version = "none"
-	}
-
 	configfile := appconfig1
 	bytes, err := ioutil.ReadFile(appconfig1)
 	if err != nil {
@@ -234,21 +393,50 @@ func main() {
 		}
 		log.Fatal("unable to read app json file: ", appconfig1, " got: ", err)
 	}
-	var config Config
+	var config shared.Config
 	err = json.Unmarshal(bytes, &config)
 	if err != nil {
 		log.Fatal("unable to parse app json file: ", configfile, " got: ", err)
-		return
 	}
 
+	err = shared.CheckEnv(config.Env)
+	if err != nil {
+		log.Fatal("bad env in app json file: ", configfile, " got: ", err)
+	}
+	configIgnore, err = config.Ignore()
+	if err != nil {
+		log.Fatal("bad app json file: ", configfile, " got: ", err)
+	}
+	gitignore = config.GitIgnore
+
 	if *host == "" {
 		*host = "ssh:" + config.Hostname
+		for _, name := range config.Hosts() {
+			if name != "" && !shared.StartsWith(name, "*.") {
+				*host = "ssh:" + name
+				break
+			}
+		}
 	}
+	return config
+}
 
-	log.Print("uploading app: ", config.Name, " version: ", version, " to: ", *host)
+// appName returns name if not empty, or the name from the app config, the app config is also read if no host is set
+func appName(name string) string {
+	if name != "" && *host != "" {
+		return name
+	}
+	config := loadConfig()
+	if name == "" {
+		return config.Name
+	}
+	return name
+}
 
+// connect opens the admin connection to the server, directly or through ssh, and negotiates the protocol
+func connect() (io.ReadWriteCloser, *shared.Conn, shared.Hello) {
 	var conn io.ReadWriteCloser
-	//var err error
+	var err error
 	if shared.StartsWith(*host, "ssh") {
 		conn, err = dialSSH(*host)
 		conn.Write([]byte{0, 0, 0, 0})
@@ -263,62 +451,154 @@ func main() {
 		log.Fatal(err)
 	}
 
-	app := shared.AppMessage{
-		Name:    config.Name,
-		Version: version,
-		Command: config.Command,
-		Hosts:   []string{config.Hostname},
-		Env:     config.Env,
+	c := shared.NewConn(bufio.NewReader(conn), conn)
+	err = c.WriteJSON(shared.NewHello())
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	// use tls if appropriate
-	if config.Certificate != nil && config.PrivateKey != nil {
-		app.TLS = true
-		if *apppath == "." {
-			skipfiles[*config.Certificate] = true
-			skipfiles[*config.PrivateKey] = true
-		}
-		if config.LetsEncrypt != nil {
-			log.Fatal("cannot configure both 'certificate'/'privatekey' and 'letsencrypt'")
-		}
-		if config.HTTPSOnly {
-			app.HTTPSOnly = true
+	var status shared.Status
+	err = c.ReadJSON(&status)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !status.Ok {
+		if status.Msg == "" || shared.StartsWith(status.Msg, "unknown op") {
+			log.Fatal("server does not support protocol negotiation, upgrade lambdaroach")
 		}
+		log.Fatal(status.Msg)
+	}
+	var hello shared.Hello
+	err = c.ReadJSON(&hello)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if hello.Protocol >= shared.FramedProtocolVersion {
+		c.SetFramed()
 	}
+	return conn, c, hello
+}
 
-	// or use letsencrypt
-	if config.LetsEncrypt != nil {
-		app.LetsEncryptEmail = *config.LetsEncrypt
-		if config.HTTPSOnly {
-			app.HTTPSOnly = true
-		}
+// readStatus reads a status message and exits if it is not ok
+func readStatus(c *shared.Conn) shared.Status {
+	var status shared.Status
+	err := c.ReadJSON(&status)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !status.Ok {
+		log.Fatal(status.Msg)
+	}
+	return status
+}
+
+func main() {
+	log.SetFlags(log.Flags() | log.Lshortfile)
+	log.SetPrefix(fmt.Sprintf("%s ", path.Base(os.Args[0])))
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "secrets":
+		secrets(loadConfig(), flag.Args()[1:])
+		return
+	case "update":
+		update(loadConfig(), flag.Args()[1:])
+		return
+	case "logs":
+		logs(flag.Args()[1:])
+		return
+	case "events":
+		events(flag.Args()[1:])
+		return
+	case "diff":
+		diff(loadConfig(), flag.Args()[1:])
+		return
+	case "deploy":
+		flags := flag.NewFlagSet("deploy", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "check the upload on the server, without activating it")
+		flags.Parse(flag.Args()[1:])
+		deploy(loadConfig(), versionArg(flags.Arg(0)), *dryRun)
+		return
+	}
+
+	deploy(loadConfig(), versionArg(flag.Arg(0)), false)
+}
+
+// versionArg returns the version name of a deploy, "none" if not given
+func versionArg(version string) string {
+	if version == "" {
+		return "none"
+	}
+	return version
+}
+
+// deploy uploads the app, handles `roachctl [version]` and `roachctl deploy [-dry-run] [version]`
+func deploy(config shared.Config, version string, dryRun bool) {
+	app, err := config.AppMessage(version)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if app.TLS && *apppath == "." {
+		skipfiles[*config.Certificate] = true
+		skipfiles[*config.PrivateKey] = true
+	}
+	if *listfiles {
+		listFiles(*apppath)
+		return
 	}
 
-	err = shared.WriteJSON0(conn, app)
+	log.Print("uploading app: ", config.Name, " version: ", version, " to: ", *host)
+	conn, c, hello := connect()
+	defer conn.Close()
+
+	if *archive != "" && !hello.Has(shared.CapArchive) {
+		log.Fatal("server does not support archives, upgrade lambdaroach")
+	}
+	if dryRun && !hello.Has(shared.CapDryRun) {
+		log.Fatal("server does not support dry runs, upgrade lambdaroach")
+	}
+	app.DryRun = dryRun
+	if len(app.Paths) > 0 && !hello.Has(shared.CapPaths) {
+		log.Fatal("server does not support paths, upgrade lambdaroach")
+	}
+	if app.Rules != nil && !hello.Has(shared.CapRules) {
+		log.Fatal("server does not support rules, upgrade lambdaroach")
+	}
+	if app.Static != nil && !hello.Has(shared.CapStatic) {
+		log.Fatal("server does not support static options, upgrade lambdaroach")
+	}
+	if app.Compress != nil && !hello.Has(shared.CapCompress) {
+		log.Fatal("server does not support compress, upgrade lambdaroach")
+	}
+	app.Incremental = *archive == "" && !*full && hello.Has(shared.CapIncremental)
+	if *archive != "" && app.TLS {
+		app.PrivateFiles = []string{*config.Certificate, *config.PrivateKey}
+	}
+	compression := c.SetCompression(hello)
+	err = c.WriteJSON(app)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	in := bufio.NewReader(conn)
 	var accept shared.Accept
-	err = shared.ReadJSON0(in, &accept)
+	err = c.ReadJSON(&accept)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Print("uploading app: ", app, " as: ", accept.ID)
+	log.Print("uploading app: ", app.Name, " version: ", accept.Version, " as: ", accept.ID)
 
 	var filecount = 0
 	var bytecount = int64(0)
+	var digest = ""
 
 	// send cert.pem and key.pem
 	if app.TLS {
-		written, err2 := sendFile(*config.Certificate, "cert.pem", conn)
+		written, _, err2 := sendFile(*config.Certificate, "cert.pem", c)
 		if err2 != nil {
 			log.Fatal(err2)
 		}
 		filecount++
 		bytecount += int64(written)
-		written, err2 = sendFile(*config.PrivateKey, "key.pem", conn)
+		written, _, err2 = sendFile(*config.PrivateKey, "key.pem", c)
 		if err2 != nil {
 			log.Fatal(err2)
 		}
@@ -327,24 +607,45 @@ func main() {
 		log.Print("uploaded certificate and private key")
 	}
 
-	log.Print("uploading files...")
-	filecount, bytecount = sendFiles(*apppath, "", conn)
+	if *archive != "" {
+		log.Print("uploading archive: ", *archive)
+		written, err2 := sendArchive(*archive, c)
+		if err2 != nil {
+			log.Fatal(err2)
+		}
+		filecount, bytecount = 1, written
+	} else if accept.Incremental {
+		log.Print("uploading changed files...")
+		filecount, bytecount, digest = sendManifest(*apppath, c)
+	} else {
+		log.Print("uploading files...")
+		filecount, bytecount, digest = sendFiles(*apppath, "", c)
+	}
 
-	file := shared.FileMessage{}
-	err = shared.WriteJSON0(conn, file)
+	file := shared.FileMessage{Hash: digest}
+	if accept.Incremental {
+		file.Hash = ""
+	}
+	err = c.WriteJSON(file)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.Print("uploaded files: ", filecount, ", total bytes: ", bytecount)
+	if data, sent := c.DataCounts(); compression != "" && data > 0 {
+		log.Printf("compressed with %s: %d bytes sent, %.1f%%", compression, sent, 100*float64(sent)/float64(data))
+	}
 
-	var status shared.Status
-	err = shared.ReadJSON0(in, &status)
-	if err != nil {
-		log.Fatal(err)
+	status := readStatus(c)
+	if digest != "" && status.Digest != digest {
+		log.Fatal("deployed files do not match, digest: ", status.Digest, " expected: ", digest)
 	}
-	if !status.Ok {
-		log.Fatal(status.Msg)
+	if dryRun {
+		log.Print("ok, dry run, not activated version: ", accept.Version, " digest: ", status.Digest)
+		return
+	}
+	if status.Version != 0 && status.Version != accept.Version {
+		log.Print("activated as version: ", status.Version, ", another deploy took version: ", accept.Version)
 	}
-	log.Print("ok")
+	log.Print("ok, digest: ", status.Digest)
 }
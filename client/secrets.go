@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"lambdaroach/shared"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// stty runs stty on the terminal connected to stdin
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// readSecret reads the secret value from stdin, without echoing it if stdin is a terminal
+func readSecret(key string) string {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if stat.Mode()&os.ModeCharDevice == 0 {
+		bytes, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return strings.TrimSuffix(string(bytes), "\n")
+	}
+
+	fmt.Fprintf(os.Stderr, "value for %s: ", key)
+	if err := stty("-echo"); err != nil {
+		log.Fatal("unable to turn off echo: ", err)
+	}
+	defer fmt.Fprintln(os.Stderr)
+	defer stty("echo")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		log.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// secrets handles `roachctl secrets set|unset|list [KEY]`, values are never printed
+func secrets(config shared.Config, args []string) {
+	usage := "usage: roachctl secrets set KEY | unset KEY | list"
+	if len(args) < 1 {
+		log.Fatal(usage)
+	}
+	msg := shared.SecretMessage{Name: config.Name}
+	switch args[0] {
+	case "set":
+		msg.Op = shared.OpSecretSet
+	case "unset":
+		msg.Op = shared.OpSecretUnset
+	case "list":
+		msg.Op = shared.OpSecretList
+	default:
+		log.Fatal(usage)
+	}
+	if msg.Op != shared.OpSecretList {
+		if len(args) != 2 {
+			log.Fatal(usage)
+		}
+		msg.Key = args[1]
+		if err := shared.CheckEnvName(msg.Key); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if msg.Op == shared.OpSecretSet {
+		msg.Value = readSecret(msg.Key)
+	}
+
+	conn, c, _ := connect()
+	defer conn.Close()
+	err := c.WriteJSON(msg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	readStatus(c)
+
+	if msg.Op == shared.OpSecretList {
+		var list shared.SecretList
+		err = c.ReadJSON(&list)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range list.Keys {
+			fmt.Println(key)
+		}
+		return
+	}
+	log.Print("ok")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"lambdaroach/shared"
+	"log"
+	"strings"
+)
+
+// update handles `roachctl update [-command cmd] [-unset KEY,...] [KEY=VALUE ...]`, creating a new version of the app
+// on the server without uploading any files
+func update(config shared.Config, args []string) {
+	flags := flag.NewFlagSet("update", flag.ExitOnError)
+	command := flags.String("command", "", "replace the command of the app")
+	unset := flags.String("unset", "", "comma separated list of environment variables to remove")
+	flags.Parse(args)
+
+	msg := shared.UpdateMessage{Op: shared.OpUpdate, Name: config.Name, Env: flags.Args()}
+	if *unset != "" {
+		msg.Unset = strings.Split(*unset, ",")
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "command" {
+			msg.Command = command
+		}
+	})
+	if len(msg.Env) == 0 && len(msg.Unset) == 0 && msg.Command == nil {
+		log.Fatal("usage: roachctl update [-command cmd] [-unset KEY,...] [KEY=VALUE ...]")
+	}
+	err := shared.CheckEnv(msg.Env)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, c, _ := connect()
+	defer conn.Close()
+	err = c.WriteJSON(msg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	readStatus(c)
+
+	var accept shared.Accept
+	err = c.ReadJSON(&accept)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Print("updated app: ", config.Name, " version: ", accept.Version)
+}
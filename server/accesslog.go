@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"lambdaroach/shared"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var accessLogFile = flag.String("accesslog", "", "file to write the access log to, rotated like app logs, default is the server log")
+var accessLogFormat = flag.String("accesslogformat", "combined", "access log format: common, combined or json")
+
+var accessLock = sync.Mutex{}
+var accessLog = rotatingFile{}
+
+// accessWriter records what is written to the client, and what served it, for the access log
+type accessWriter struct {
+	http.ResponseWriter
+	start    time.Time
+	status   int
+	bytes    int64
+	upstream time.Duration // time from writing the request to the app until its response headers
+	site     *Site
+	running  *RunningSite
+	msg      string             // reason of an error
+	headers  shared.HeaderRules // response header rules of the site
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.headers.Apply(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(200)
+	}
+	written, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(written)
+	return written, err
+}
+
+func (w *accessWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("connection cannot be hijacked")
+}
+
+// accessEntry is a line in the access log, json field names are used as is for the json format
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer"`
+	UserAgent string    `json:"useragent"`
+	Site      string    `json:"site,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	Instance  int32     `json:"instance,omitempty"`
+	Upstream  float64   `json:"upstream"` // seconds
+	Total     float64   `json:"total"`    // seconds
+	Error     string    `json:"error,omitempty"`
+}
+
+func newAccessEntry(w *accessWriter, r *http.Request) accessEntry {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	entry := accessEntry{
+		Time:      w.start,
+		Client:    client,
+		Method:    r.Method,
+		Host:      r.Host,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Status:    w.status,
+		Bytes:     w.bytes,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		Upstream:  w.upstream.Seconds(),
+		Total:     time.Since(w.start).Seconds(),
+		Error:     w.msg,
+	}
+	if entry.Status == 0 {
+		entry.Status = 200
+	}
+	if w.site != nil {
+		entry.Site = w.site.id
+		entry.Version = w.site.version
+	}
+	if w.running != nil {
+		entry.Instance = w.running.id
+	}
+	return entry
+}
+
+// quote a string for the common log format, empty is "-"
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func clfDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// format returns the entry in the common, combined or json format, the common formats are followed by site, instance,
+// upstream and total latency
+func (e accessEntry) format(format string) string {
+	if format == "json" {
+		bytes, err := json.Marshal(e)
+		if err != nil {
+			return err.Error()
+		}
+		return string(bytes)
+	}
+
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprintf("%d", e.Bytes)
+	}
+	line := fmt.Sprintf("%s - - [%s] %s %d %s", e.Client, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		clfQuote(e.Method+" "+e.URI+" "+e.Proto), e.Status, size)
+	if format == "combined" {
+		line += " " + clfQuote(e.Referer) + " " + clfQuote(e.UserAgent)
+	}
+	site := "-"
+	if e.Site != "" {
+		site = fmt.Sprintf("%s@%d", e.Site, e.Version)
+	}
+	instance := "-"
+	if e.Instance != 0 {
+		instance = fmt.Sprintf("%d", e.Instance)
+	}
+	line += fmt.Sprintf(" %s %s %s %0.3f %0.3f", clfDash(e.Host), site, instance, e.Upstream, e.Total)
+	if e.Error != "" {
+		line += " " + clfQuote(e.Error)
+	}
+	return line
+}
+
+func checkAccessLogFormat() error {
+	switch *accessLogFormat {
+	case "common", "combined", "json":
+		return nil
+	}
+	return errors.New("unknown access log format: " + *accessLogFormat)
+}
+
+// logAccess writes the access log entry of a request, updates the metrics, and sends it to anyone following the logs
+// of the app
+func logAccess(w *accessWriter, r *http.Request) {
+	entry := newAccessEntry(w, r)
+	observeRequest(entry)
+	line := entry.format(*accessLogFormat)
+
+	if *accessLogFile == "" {
+		log.Print(line)
+	} else {
+		func() {
+			accessLock.Lock()
+			defer accessLock.Unlock()
+			accessLog.name = *accessLogFile
+			if _, err := accessLog.Write([]byte(line + "\n")); err != nil {
+				log.Print("error writing access log: ", err)
+			}
+		}()
+	}
+
+	if entry.Site != "" {
+		getAppLog(entry.Site).access(shared.LogLine{
+			Time:     entry.Time,
+			App:      entry.Site,
+			Version:  entry.Version,
+			Instance: entry.Instance,
+			Stream:   "access",
+			Line:     line,
+		})
+	}
+}
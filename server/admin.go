@@ -3,7 +3,12 @@ package main
 import (
 	"bufio"
 	"crypto/md5"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"lambdaroach/shared"
@@ -27,7 +32,11 @@ func cleanFilePerm(perm int) os.FileMode {
 }
 
 func writeFile(base string, file shared.FileMessage, r io.Reader) (int64, error) {
-	out, err := os.OpenFile(path.Join(base, file.Name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cleanFilePerm(file.Perm))
+	name, err := safePath(base, file.Name)
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cleanFilePerm(file.Perm))
 	if err != nil {
 		return 0, err
 	}
@@ -47,15 +56,19 @@ func cleanDirPerm(perm int) os.FileMode {
 
 func writeDir(base string, file shared.FileMessage) error {
 	if !shared.EndsWith(file.Name, "/") {
-		log.Fatal("bad writeDir")
+		return errors.New("not a directory: " + file.Name)
 	}
 	if file.Size != 0 {
-		log.Fatal("bad writeDir")
+		return errors.New("directory with a size: " + file.Name)
 	}
-	return os.Mkdir(path.Join(base, file.Name), cleanDirPerm(file.Perm))
+	name, err := safePath(base, file.Name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(name, cleanDirPerm(file.Perm))
 }
 
-func errorConnection(base string, conn net.Conn, msg string, cerr error) bool {
+func errorConnection(base string, c *shared.Conn, msg string, cerr error) bool {
 	log.Print("error receiving app: ", msg, " ", cerr)
 	if base != "" {
 		err := os.RemoveAll(base)
@@ -63,22 +76,22 @@ func errorConnection(base string, conn net.Conn, msg string, cerr error) bool {
 			log.Print(err)
 		}
 	}
-	err := shared.WriteJSON0(conn, shared.Status{false, msg})
+	err := c.WriteJSON(shared.Status{Ok: false, Msg: msg})
 	if err != nil {
 		log.Print(err)
 	}
 	return false
 }
 
-func handleConnection(conn net.Conn) bool {
+func handleConnection(conn net.Conn, in *bufio.Reader) bool {
 	defer conn.Close()
-	in := bufio.NewReader(conn)
+	c := shared.NewConn(in, conn)
 
 	// skip first series of zeros, usefull for ssh and password/passphrase questions
 	for {
 		b, err := in.ReadByte()
 		if err != nil {
-			return errorConnection("", conn, "error reading connection", err)
+			return errorConnection("", c, "error reading connection", err)
 		}
 		if b != 0 {
 			in.UnreadByte()
@@ -86,106 +99,573 @@ func handleConnection(conn net.Conn) bool {
 		}
 	}
 
-	var app shared.AppMessage
-	err := shared.ReadJSON0(in, &app)
+	first, op, err := readOp(c)
 	if err != nil {
-		return errorConnection("", conn, "error reading first message", err)
+		return errorConnection("", c, "error reading first message", err)
+	}
+	if op.Op == shared.OpHello {
+		if !handleHello(c, first) {
+			return true
+		}
+		first, op, err = readOp(c)
+		if err != nil {
+			return errorConnection("", c, "error reading first message", err)
+		}
 	}
-	log.Print("admin: preparing app ", app)
 
-	id := uniuri.New()
-	base := "/tmp/" + id
-	err = os.MkdirAll(base, 0755)
+	switch op.Op {
+	case "":
+		return handleUpload(c, first)
+	case shared.OpSecretSet, shared.OpSecretUnset, shared.OpSecretList:
+		return handleSecret(c, first)
+	case shared.OpUpdate:
+		return handleUpdate(c, first)
+	case shared.OpLogs:
+		return handleLogs(c, first)
+	case shared.OpEvents:
+		return handleEvents(c, first)
+	case shared.OpDiff:
+		return handleDiff(c, first)
+	}
+	return errorConnection("", c, "unknown op: "+op.Op, nil)
+}
+
+// readOp reads the first message of an op
+func readOp(c *shared.Conn) (json.RawMessage, shared.Op, error) {
+	var first json.RawMessage
+	var op shared.Op
+	err := c.ReadJSON(&first)
+	if err == nil {
+		err = json.Unmarshal(first, &op)
+	}
+	return first, op, err
+}
+
+// handleHello negotiates the protocol with clients that send a Hello, clients that don't are protocol version 1
+func handleHello(c *shared.Conn, first []byte) bool {
+	var hello shared.Hello
+	err := json.Unmarshal(first, &hello)
 	if err != nil {
-		return errorConnection("", conn, "error creating app storage", err)
+		errorConnection("", c, "error reading hello", err)
+		return false
 	}
-	log.Print("accept app: ", app.Name, " as: ", id)
+	res, err := shared.Negotiate(shared.NewHello(), hello)
+	if err != nil {
+		errorConnection("", c, err.Error(), nil)
+		return false
+	}
+	log.Print("admin: client protocol: ", hello.Protocol, " using: ", res.Protocol, " ", res.Capabilities)
+	err = c.WriteJSON(shared.Status{Ok: true})
+	if err == nil {
+		err = c.WriteJSON(res)
+	}
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	if res.Protocol >= shared.FramedProtocolVersion {
+		c.SetFramed()
+	}
+	return true
+}
 
-	var version = 1
-	lastSite := findSite(app.Name)
-	if lastSite != nil {
-		version = lastSite.version + 1
+func handleSecret(c *shared.Conn, first []byte) bool {
+	var msg shared.SecretMessage
+	err := json.Unmarshal(first, &msg)
+	if err != nil {
+		return errorConnection("", c, "error reading secret message", err)
 	}
+	if msg.Name == "" {
+		return errorConnection("", c, "missing app name", nil)
+	}
+	log.Print("admin: ", msg.Op, " app: ", msg.Name, " key: ", msg.Key)
 
-	err = shared.WriteJSON0(conn, shared.Accept{version, id})
+	switch msg.Op {
+	case shared.OpSecretList:
+		err = c.WriteJSON(shared.Status{Ok: true})
+		if err == nil {
+			err = c.WriteJSON(shared.SecretList{Keys: listSecrets(msg.Name)})
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		return true
+	case shared.OpSecretSet:
+		err = shared.CheckEnvName(msg.Key)
+		if err != nil {
+			return errorConnection("", c, err.Error(), nil)
+		}
+		err = setSecret(msg.Name, msg.Key, msg.Value)
+	case shared.OpSecretUnset:
+		var found bool
+		found, err = unsetSecret(msg.Name, msg.Key)
+		if err == nil && !found {
+			return errorConnection("", c, "no such secret: "+msg.Key, nil)
+		}
+	}
 	if err != nil {
-		return errorConnection(base, conn, "error writing accept", err)
+		return errorConnection("", c, "error saving secrets", err)
 	}
 
-	var needtls = 0
-	if app.TLS {
-		needtls = 2
+	restartApp(msg.Name)
+	err = c.WriteJSON(shared.Status{Ok: true})
+	if err != nil {
+		log.Print(err)
 	}
-	var pem = []byte{}
-	var key = []byte{}
+	return true
+}
 
-	var files = 0
-	var bytes = int64(0)
-	for {
-		var file shared.FileMessage
-		err = shared.ReadJSON0(in, &file)
+// updateEnv returns a copy of env without the unset keys, and with the set entries replacing or added
+func updateEnv(env, set, unset []string) []string {
+	remove := map[string]bool{}
+	for _, key := range unset {
+		remove[key] = true
+	}
+	for _, entry := range set {
+		remove[shared.EnvName(entry)] = true
+	}
+	res := []string{}
+	for _, entry := range env {
+		if !remove[shared.EnvName(entry)] {
+			res = append(res, entry)
+		}
+	}
+	return append(res, set...)
+}
+
+// redeploySite adds a new version of the app using the files of from, the new version shares the data directory,
+// the running instance of the version it replaces bleeds out, reason is why, like "update"
+func redeploySite(from *Site, env []string, command string, reason string) (*Site, error) {
+	site := &Site{
+		id:            from.id,
+		hostnames:     from.hostnames,
+		paths:         from.paths,
+		stripPath:     from.stripPath,
+		rules:         from.rules,
+		staticOptions: from.staticOptions,
+		compress:      from.compress,
+		env:           env,
+		command:       command,
+		data:          from.data,
+		certid:        from.certid,
+		httpsOnly:     from.httpsOnly,
+	}
+	previous, err := addSite(site)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		retireSite(previous, reason)
+	}
+	return site, nil
+}
+
+func handleUpdate(c *shared.Conn, first []byte) bool {
+	var msg shared.UpdateMessage
+	err := json.Unmarshal(first, &msg)
+	if err != nil {
+		return errorConnection("", c, "error reading update message", err)
+	}
+	log.Print("admin: update app: ", msg.Name, " env: ", len(msg.Env), " unset: ", msg.Unset, " command: ", msg.Command != nil)
+
+	err = shared.CheckEnv(msg.Env)
+	if err != nil {
+		return errorConnection("", c, err.Error(), nil)
+	}
+	for _, key := range msg.Unset {
+		err = shared.CheckEnvName(key)
 		if err != nil {
-			return errorConnection(base, conn, "error reading file message", err)
+			return errorConnection("", c, err.Error(), nil)
 		}
-		if file.Name == "" && file.Size <= 0 {
-			log.Print("received full file list: ", files, ", total bytes: ", bytes)
-			break
+	}
+
+	lastSite := findSite(msg.Name)
+	if lastSite == nil {
+		return errorConnection("", c, "no such app: "+msg.Name, nil)
+	}
+	command := lastSite.command
+	if msg.Command != nil {
+		command = *msg.Command
+	}
+	site, err := redeploySite(lastSite, updateEnv(lastSite.env, msg.Env, msg.Unset), command, "update")
+	if err != nil {
+		return errorConnection("", c, err.Error(), nil)
+	}
+	siteEvent(shared.EventDeployed, site, nil, "update")
+
+	err = c.WriteJSON(shared.Status{Ok: true})
+	if err == nil {
+		err = c.WriteJSON(shared.Accept{Version: site.version, ID: path.Base(site.data)})
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	return true
+}
+
+func handleLogs(c *shared.Conn, first []byte) bool {
+	var msg shared.LogsMessage
+	err := json.Unmarshal(first, &msg)
+	if err != nil {
+		return errorConnection("", c, "error reading logs message", err)
+	}
+	if msg.Name == "" {
+		return errorConnection("", c, "missing app name", nil)
+	}
+
+	logs := getAppLog(msg.Name)
+	if !msg.Follow {
+		lines := logs.query(msg.Since, msg.Until, msg.Stream, msg.Limit)
+		err = writeLogLines(c, lines)
+		if err == nil {
+			err = c.WriteJSON(shared.LogLine{})
 		}
+		if err != nil {
+			log.Print(err)
+		}
+		return true
+	}
 
-		if file.Size > 10*1024*1024 {
-			return errorConnection(base, conn, "file size too large", nil)
+	lines, tail := logs.tail(msg.Since, msg.Until, msg.Stream, msg.Limit)
+	defer logs.untail(tail)
+	log.Print("admin: following logs of app: ", msg.Name)
+
+	// the client never sends anything, reading only returns when the connection closes
+	closed := make(chan bool)
+	go func() {
+		for {
+			if _, err := c.Reader().ReadByte(); err != nil {
+				close(closed)
+				return
+			}
 		}
+	}()
 
-		if shared.EndsWith(file.Name, "/") && file.Size <= 0 {
-			if base != "" {
-				err := writeDir(base, file)
-				if err != nil {
-					return errorConnection(base, conn, "error creating dir", err)
-				}
+	err = writeLogLines(c, lines)
+	for err == nil {
+		select {
+		case line := <-tail:
+			if line.Stream == "access" && !msg.Access {
+				continue
 			}
-			continue
+			if msg.Stream != "" && line.Stream != msg.Stream {
+				continue
+			}
+			err = c.WriteJSON(line)
+		case <-closed:
+			log.Print("admin: stopped following logs of app: ", msg.Name)
+			return true
 		}
+	}
+	log.Print("admin: stopped following logs of app: ", msg.Name, " ", err)
+	return true
+}
 
-		files++
-		bytes += int64(file.Size)
-		filein := io.LimitReader(in, int64(file.Size))
+// writeLogLines writes a Status and the lines
+func writeLogLines(c *shared.Conn, lines []shared.LogLine) error {
+	err := c.WriteJSON(shared.Status{Ok: true})
+	for _, line := range lines {
+		if err != nil {
+			return err
+		}
+		err = c.WriteJSON(line)
+	}
+	return err
+}
+
+func handleEvents(c *shared.Conn, first []byte) bool {
+	var msg shared.EventsMessage
+	err := json.Unmarshal(first, &msg)
+	if err != nil {
+		return errorConnection("", c, "error reading events message", err)
+	}
 
-		if needtls == 2 {
-			needtls = 1
-			pem, err = ioutil.ReadAll(filein)
+	events, err := queryJournal(msg.Name, msg.Type, msg.Since, msg.Limit)
+	if err != nil {
+		return errorConnection("", c, "error reading events", err)
+	}
+	err = c.WriteJSON(shared.Status{Ok: true})
+	for _, event := range events {
+		if err != nil {
+			break
+		}
+		err = c.WriteJSON(event)
+	}
+	if err == nil {
+		err = c.WriteJSON(shared.Event{})
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	return true
+}
+
+// handleDiff sends the config and files of the active version of an app, the client compares them with its own
+func handleDiff(c *shared.Conn, first []byte) bool {
+	var msg shared.DiffMessage
+	err := json.Unmarshal(first, &msg)
+	if err != nil {
+		return errorConnection("", c, "error reading diff message", err)
+	}
+	log.Print("admin: diff app: ", msg.Name)
+
+	site := findSite(msg.Name)
+	if site == nil {
+		return errorConnection("", c, "no such app: "+msg.Name, nil)
+	}
+	manifest, err := manifestDir(site.data)
+	if err != nil {
+		return errorConnection("", c, "error reading app files", err)
+	}
+	err = c.WriteJSON(shared.Status{Ok: true})
+	if err == nil {
+		err = c.WriteJSON(shared.Deployed{
+			Version:   site.version,
+			Command:   site.command,
+			Hosts:     site.hostnames,
+			Paths:     site.paths,
+			StripPath: site.stripPath,
+			Rules:     site.rules,
+			Static:    site.staticOptions,
+			Compress:  site.compress,
+			Env:       site.env,
+			HTTPSOnly: site.httpsOnly,
+			Manifest:  manifest,
+		})
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	return true
+}
+
+// readCertFile reads the certificate or private key, sent as the first files of an app using tls
+func readCertFile(c *shared.Conn) ([]byte, error) {
+	var file shared.FileMessage
+	err := c.ReadJSON(&file)
+	if err != nil {
+		return nil, err
+	}
+	if file.Size < 0 || int64(file.Size) > *maxFileSize {
+		return nil, errors.New("bad file size")
+	}
+	bytes, err := ioutil.ReadAll(c.Data(int64(file.Size)))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(bytes)
+	if file.Hash != "" && hex.EncodeToString(sum[:]) != file.Hash {
+		return nil, errors.New("hash mismatch")
+	}
+	return bytes, nil
+}
+
+// receiveFiles writes the files, directories and archives of an upload into base, until an empty FileMessage, which
+// has the digest of all files, if the client sent one
+func receiveFiles(base string, c *shared.Conn) (files int, bytes int64, digest string, err error) {
+	for {
+		var file shared.FileMessage
+		err = c.ReadJSON(&file)
+		if err != nil {
+			return files, bytes, "", fmt.Errorf("error reading file message: %v", err)
+		}
+		if file.Size < 0 {
+			return files, bytes, "", errors.New("negative file size")
+		}
+		if file.Name == "" && file.Size == 0 && !file.Archive {
+			return files, bytes, file.Hash, nil
+		}
+
+		if file.Archive {
+			if int64(file.Size) > *maxAppSize {
+				return files, bytes, "", errors.New("archive size too large")
+			}
+			h := sha256.New()
+			filein := io.TeeReader(c.Data(int64(file.Size)), h)
+			files, bytes, err = extractArchive(base, files, bytes, filein)
 			if err != nil {
-				return errorConnection(base, conn, "error reading pem", err)
+				return files, bytes, "", fmt.Errorf("error extracting archive: %v", err)
 			}
-			log.Print("got private certificate: ", len(pem))
+			// compressed archives can end before all bytes are read
+			io.Copy(ioutil.Discard, filein)
+			if file.Hash != "" && hex.EncodeToString(h.Sum(nil)) != file.Hash {
+				return files, bytes, "", errors.New("hash mismatch of archive")
+			}
+			os.Remove(path.Join(base, "lambda.config.json"))
 			continue
-		} else if needtls == 1 {
-			needtls = 0
-			key, err = ioutil.ReadAll(filein)
+		}
+
+		if int64(file.Size) > *maxFileSize {
+			return files, bytes, "", errors.New("file size too large")
+		}
+
+		if shared.EndsWith(file.Name, "/") && file.Size == 0 {
+			err = writeDir(base, file)
 			if err != nil {
-				return errorConnection(base, conn, "error reading key", err)
+				return files, bytes, "", fmt.Errorf("error creating dir: %v", err)
 			}
-			log.Print("got private key: ", len(key))
 			continue
 		}
 
-		_, err2 := writeFile(base, file, filein)
-		if err2 != nil {
-			return errorConnection(base, conn, "error creating file", err)
+		files++
+		bytes += int64(file.Size)
+		if files > *maxAppFiles {
+			return files, bytes, "", fmt.Errorf("too many files, maximum is: %d", *maxAppFiles)
+		}
+		if bytes > *maxAppSize {
+			return files, bytes, "", fmt.Errorf("app too large, maximum is: %d bytes", *maxAppSize)
+		}
+		h := sha256.New()
+		_, err = writeFile(base, file, io.TeeReader(c.Data(int64(file.Size)), h))
+		if err != nil {
+			return files, bytes, "", fmt.Errorf("error creating file: %v", err)
+		}
+		if file.Hash != "" && hex.EncodeToString(h.Sum(nil)) != file.Hash {
+			return files, bytes, "", errors.New("hash mismatch of file: " + file.Name)
+		}
+	}
+}
+
+func handleUpload(c *shared.Conn, first []byte) bool {
+	var app shared.AppMessage
+	err := json.Unmarshal(first, &app)
+	if err != nil {
+		return errorConnection("", c, "error reading app message", err)
+	}
+	// older clients send the hosts as configured, requests are matched lower case
+	app.Hosts = shared.CleanHosts(app.Hosts)
+	log.Print("admin: preparing app: ", app.Name, " version: ", app.Version, " hosts: ", app.Hosts)
+	err = shared.CheckEnv(app.Env)
+	if err != nil {
+		return errorConnection("", c, err.Error(), nil)
+	}
+
+	id := uniuri.New()
+	base, err := stageApp(id)
+	if err != nil {
+		return errorConnection("", c, "error creating app storage", err)
+	}
+	log.Print("accept app: ", app.Name, " as: ", id)
+
+	version := nextVersion(app.Name)
+	err = c.WriteJSON(shared.Accept{Version: version, ID: id, Incremental: app.Incremental})
+	if err != nil {
+		return errorConnection(base, c, "error writing accept", err)
+	}
+
+	var pem, key []byte
+	if app.TLS {
+		pem, err = readCertFile(c)
+		if err != nil {
+			return errorConnection(base, c, "error reading pem", err)
+		}
+		log.Print("got private certificate: ", len(pem))
+		key, err = readCertFile(c)
+		if err != nil {
+			return errorConnection(base, c, "error reading key", err)
+		}
+		log.Print("got private key: ", len(key))
+	}
+
+	var files int
+	var bytes int64
+	var expected string
+	if app.Incremental {
+		files, bytes, expected, err = receiveManifest(base, c)
+	} else {
+		files, bytes, expected, err = receiveFiles(base, c)
+	}
+	if err != nil {
+		return errorConnection(base, c, err.Error(), nil)
+	}
+	log.Print("received full file list: ", files, ", total bytes: ", bytes)
+	for _, name := range app.PrivateFiles {
+		if file, err := safePath(base, name); err == nil {
+			os.Remove(file)
+		}
+	}
+
+	// check what is on disk is exactly what the client sent, before activating it
+	digest, err := digestDir(base)
+	if err != nil {
+		return errorConnection(base, c, "error checking files", err)
+	}
+	if expected != "" && digest != expected {
+		return errorConnection(base, c, "digest mismatch, expected: "+expected+" got: "+digest, nil)
+	}
+	err = checkApp(app, base, pem, key)
+	if err != nil {
+		return errorConnection(base, c, err.Error(), nil)
+	}
+	if app.DryRun {
+		log.Print("dry run of app: ", app.Name, " ok, discarding: ", id)
+		os.RemoveAll(base)
+		err = c.WriteJSON(shared.Status{Ok: true, Digest: digest})
+		if err != nil {
+			log.Print(err)
 		}
-		//log.Print("file: ", file.Name, " size: ", file.Size)
+		return true
+	}
+	staging := base
+	base, err = commitApp(staging, id)
+	if err != nil {
+		return errorConnection(staging, c, "error storing app", err)
 	}
 
-	err = shared.WriteJSON0(conn, shared.Status{true, ""})
+	// only acknowledge once the app is in place and activated
+	site, err := activateSite(app, base, pem, key)
+	if err != nil {
+		return errorConnection(base, c, "error activating app", err)
+	}
+	err = c.WriteJSON(shared.Status{Ok: true, Digest: digest, Version: site.version})
 	if err != nil {
 		log.Print(err)
 	}
+	return true
+}
+
+// nextVersion returns the version a new upload of app name will probably get, the version is only assigned when it is
+// activated, another deploy may be activated first
+func nextVersion(name string) int {
+	lastSite := findSite(name)
+	if lastSite != nil {
+		return lastSite.version + 1
+	}
+	return 1
+}
 
+// activateSite adds the new version of the app stored in base, adds the certificate, and registers at letsencrypt
+func activateSite(app shared.AppMessage, base string, pem, key []byte) (*Site, error) {
 	var certid = []byte{}
 	if len(pem) > 0 && len(key) > 0 {
 		h := md5.New()
 		h.Write(pem)
 		h.Write(key)
 		certid = h.Sum(nil)
+	}
+	paths := app.Paths
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	site := &Site{
+		id:            app.Name,
+		hostnames:     app.Hosts,
+		paths:         paths,
+		stripPath:     app.StripPath,
+		rules:         app.Rules,
+		staticOptions: app.Static,
+		compress:      app.Compress,
+		env:           app.Env,
+		command:       app.Command,
+		data:          base,
+		certid:        certid,
+		httpsOnly:     app.HTTPSOnly,
+	}
+	if _, err := addSite(site); err != nil {
+		return nil, err
+	}
+
+	if len(certid) > 0 {
 		if !hasCertificate(certid) {
 			log.Print("adding certificate to https")
 			cert, err2 := tls.X509KeyPair(pem, key)
@@ -202,25 +682,32 @@ func handleConnection(conn net.Conn) bool {
 			log.Print("letsencrypt already registered")
 		} else {
 			// TODO this is done only once :( ... should be more flexible
-			log.Print("registering at letsencrypt.org: ", app.LetsEncryptEmail, app.Hosts)
-			letsEncrypt.SetHosts(app.Hosts)
+			// wildcard certificates need a dns challenge, which is not supported
+			hosts := []string{}
+			for _, host := range app.Hosts {
+				if !shared.StartsWith(host, "*.") {
+					hosts = append(hosts, host)
+				}
+			}
+			log.Print("registering at letsencrypt.org: ", app.LetsEncryptEmail, hosts)
+			letsEncrypt.SetHosts(hosts)
 			letsEncrypt.Register(app.LetsEncryptEmail, nil)
 		}
 	}
 
-	log.Print("adding site to server: ", app.Name, " ", version)
-	addSite(&Site{
-		id:        app.Name,
-		version:   version,
-		hostnames: app.Hosts,
-		paths:     []string{"/"},
-		env:       app.Env,
-		command:   app.Command,
-		data:      base,
-		certid:    certid,
-		httpsOnly: app.HTTPSOnly,
-	})
-	return true
+	siteEvent(shared.EventDeployed, site, nil, app.Version)
+	return site, nil
+}
+
+// acceptAdmin hands the connection to the admin http server or the admin protocol, http starts with a method like GET
+func acceptAdmin(conn net.Conn) {
+	in := bufio.NewReader(conn)
+	b, err := in.Peek(1)
+	if err == nil && b[0] >= 'A' && b[0] <= 'Z' {
+		adminHTTP.conns <- &bufferedConn{conn, in}
+		return
+	}
+	handleConnection(conn, in)
 }
 
 func serveAdmin() {
@@ -229,12 +716,15 @@ func serveAdmin() {
 		log.Fatal(err)
 	}
 	log.Printf("admin listening on port: %s", ln.Addr())
+	adminHTTP.addr = ln.Addr()
+	go serveAdminHTTP()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Print("Error in admin accept: ", err)
 			time.Sleep(50 * time.Millisecond)
+			continue
 		}
-		go handleConnection(conn)
+		go acceptAdmin(conn)
 	}
 }
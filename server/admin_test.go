@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"lambdaroach/shared"
+)
+
+// uploadConn returns a connection that reads the file messages, each followed by its data
+func uploadConn(files []shared.FileMessage, data []string) *shared.Conn {
+	buf := &bytes.Buffer{}
+	out := shared.NewConn(nil, buf)
+	for i, file := range files {
+		out.WriteJSON(file)
+		if i < len(data) {
+			buf.WriteString(data[i])
+		}
+	}
+	return shared.NewConn(bufio.NewReader(buf), ioutil.Discard)
+}
+
+func TestReceiveFiles(t *testing.T) {
+	base := t.TempDir()
+	c := uploadConn([]shared.FileMessage{{Name: "dir/"}, {Name: "dir/a.txt", Size: 5}, {Hash: "digest"}}, []string{"", "hello"})
+	files, size, digest, err := receiveFiles(base, c)
+	if err != nil || files != 1 || size != 5 || digest != "digest" {
+		t.Fatal("oeps", files, size, digest, err)
+	}
+	if data, err := ioutil.ReadFile(path.Join(base, "dir/a.txt")); err != nil || string(data) != "hello" {
+		t.Fatal("oeps", string(data), err)
+	}
+
+	// negative sizes are refused, they would lower the total or reach writeDir with a size
+	bad := [][]shared.FileMessage{
+		{{Name: "dir/", Size: -1}},
+		{{Name: "a.txt", Size: -1}},
+		{{Size: -1}},
+	}
+	for i, files := range bad {
+		if _, _, _, err := receiveFiles(t.TempDir(), uploadConn(files, nil)); err == nil {
+			t.Fatal("oeps", i)
+		}
+	}
+}
+
+func TestWriteDir(t *testing.T) {
+	base := t.TempDir()
+	if err := writeDir(base, shared.FileMessage{Name: "dir/"}); err != nil {
+		t.Fatal("oeps", err)
+	}
+	if err := writeDir(base, shared.FileMessage{Name: "file"}); err == nil {
+		t.Fatal("oeps")
+	}
+	if err := writeDir(base, shared.FileMessage{Name: "sized/", Size: 1}); err == nil {
+		t.Fatal("oeps")
+	}
+}
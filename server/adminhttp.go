@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// connListener is a net.Listener for connections accepted elsewhere, so the admin port can also serve http
+type connListener struct {
+	conns chan net.Conn
+	addr  net.Addr
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, errors.New("listener closed")
+	}
+	return conn, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// bufferedConn is a connection of which the first bytes were already read into a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	in *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+var adminHTTP = &connListener{conns: make(chan net.Conn)}
+
+// adminHeader must be set on requests that change something, browsers don't send it cross-origin without asking
+const adminHeader = "X-Lambdaroach"
+
+// isLocalhost checks if the host of a Host header or url is localhost
+func isLocalhost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host == "localhost" || host == "127.0.0.1" || host == "::1" || host == "[::1]"
+}
+
+// checkAdminRequest rejects requests web pages make the browser of the operator send to the admin port, through an
+// ssh tunnel: those with another hostname (dns rebinding), from another origin, or changing something without the
+// admin header
+func checkAdminRequest(r *http.Request) error {
+	if !isLocalhost(r.Host) {
+		return errors.New("host must be localhost")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return errors.New("foreign origin: " + origin)
+		}
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && r.Header.Get(adminHeader) != "1" {
+		return errors.New("missing header: " + adminHeader + ": 1")
+	}
+	return nil
+}
+
+// serveAdminHTTP serves the http requests on the admin port, it has the same access restrictions as the admin protocol
+func serveAdminHTTP() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveStatus)
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/api/", serveAPI)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkAdminRequest(r); err != nil {
+			log.Print("admin http: ", err)
+			http.Error(w, "403 Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+	err := http.Serve(adminHTTP, handler)
+	if err != nil {
+		log.Print("admin http: ", err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"lambdaroach/shared"
+	"lambdaroach/uniuri"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The admin api is json over http, served on the admin port, so it has the same access restrictions as the admin
+// protocol: only reachable from localhost or through ssh.
+//
+//	GET    /api/apps                  list apps
+//	GET    /api/apps/NAME             get app
+//	POST   /api/apps/NAME?version=V   deploy app, the body is a tar, tar.gz, tar.zst or zip of the app dir,
+//	                                  including lambda.config.json
+//	POST   /api/apps/NAME/rollback    new version using the files and config of the previous, or ?version=N
+//	DELETE /api/apps/NAME             remove all versions of the app
+//	GET    /api/apps/NAME/logs        query logs: ?since=10m&until=&stream=stderr&limit=100&follow=1&access=1
+//	GET    /api/events                query events: ?app=NAME&type=crashed&since=24h&limit=100
+//	GET    /api/metrics               prometheus metrics
+func serveAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "apps" && r.Method == "GET":
+		apps, _ := statusApps()
+		apiReply(w, apps)
+	case len(parts) == 1 && parts[0] == "events" && r.Method == "GET":
+		apiEvents(w, r)
+	case len(parts) == 1 && parts[0] == "metrics" && r.Method == "GET":
+		serveMetrics(w, r)
+	case len(parts) == 2 && parts[0] == "apps" && r.Method == "GET":
+		apiApp(w, parts[1])
+	case len(parts) == 2 && parts[0] == "apps" && (r.Method == "POST" || r.Method == "PUT"):
+		apiDeploy(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "apps" && r.Method == "DELETE":
+		apiDelete(w, parts[1])
+	case len(parts) == 3 && parts[0] == "apps" && parts[2] == "rollback" && r.Method == "POST":
+		apiRollback(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "apps" && parts[2] == "logs" && r.Method == "GET":
+		apiLogs(w, r, parts[1])
+	default:
+		apiError(w, http.StatusNotFound, "not found: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func apiReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Print("api: ", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	log.Print("api: ", msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(shared.Status{Ok: false, Msg: msg})
+}
+
+func apiApp(w http.ResponseWriter, name string) {
+	apps, _ := statusApps()
+	for _, app := range apps {
+		if app.ID == name {
+			apiReply(w, app)
+			return
+		}
+	}
+	apiError(w, http.StatusNotFound, "no such app: "+name)
+}
+
+// readAppFile reads and removes a file that should not be served as part of the app, like the private key
+func readAppFile(base, name string) ([]byte, error) {
+	file, err := safePath(base, name)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, os.Remove(file)
+}
+
+func apiDeploy(w http.ResponseWriter, r *http.Request, name string) {
+	id := uniuri.New()
+	base, err := stageApp(id)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "error creating app storage: "+err.Error())
+		return
+	}
+	fail := func(code int, msg string) {
+		os.RemoveAll(base)
+		apiError(w, code, msg)
+	}
+
+	files, bytes, err := extractArchive(base, 0, 0, r.Body)
+	if err != nil {
+		fail(http.StatusBadRequest, "error reading archive: "+err.Error())
+		return
+	}
+	log.Print("api: received app: ", name, " files: ", files, ", total bytes: ", bytes)
+
+	data, err := readAppFile(base, "lambda.config.json")
+	if err != nil {
+		fail(http.StatusBadRequest, "error reading lambda.config.json: "+err.Error())
+		return
+	}
+	var config shared.Config
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		fail(http.StatusBadRequest, "error parsing lambda.config.json: "+err.Error())
+		return
+	}
+	if config.Name == "" {
+		config.Name = name
+	}
+	if config.Name != name {
+		fail(http.StatusBadRequest, "name in lambda.config.json is not: "+name)
+		return
+	}
+	label := r.URL.Query().Get("version")
+	if label == "" {
+		label = "none"
+	}
+	app, err := config.AppMessage(label)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var pem, key []byte
+	if app.TLS {
+		pem, err = readAppFile(base, *config.Certificate)
+		if err == nil {
+			key, err = readAppFile(base, *config.PrivateKey)
+		}
+		if err != nil {
+			fail(http.StatusBadRequest, "error reading certificate: "+err.Error())
+			return
+		}
+	}
+	err = checkApp(app, base, pem, key)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	staging := base
+	base, err = commitApp(staging, id)
+	if err != nil {
+		base = staging
+		fail(http.StatusInternalServerError, "error storing app: "+err.Error())
+		return
+	}
+
+	site, err := activateSite(app, base, pem, key)
+	if err != nil {
+		fail(http.StatusConflict, "error activating app: "+err.Error())
+		return
+	}
+	apiReply(w, shared.Accept{Version: site.version, ID: id})
+}
+
+func apiRollback(w http.ResponseWriter, r *http.Request, name string) {
+	last := findSite(name)
+	if last == nil {
+		apiError(w, http.StatusNotFound, "no such app: "+name)
+		return
+	}
+
+	var from *Site
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "bad version: "+v)
+			return
+		}
+		from = findVersion(name, version)
+	} else {
+		for version := last.version - 1; version > 0 && from == nil; version-- {
+			from = findVersion(name, version)
+		}
+	}
+	if from == nil || from == last {
+		apiError(w, http.StatusNotFound, "no version to roll back to")
+		return
+	}
+
+	site, err := redeploySite(from, from.env, from.command, "rollback")
+	if err != nil {
+		apiError(w, http.StatusConflict, "error rolling back: "+err.Error())
+		return
+	}
+	siteEvent(shared.EventRolledBack, site, nil, "to version: "+strconv.Itoa(from.version))
+	apiReply(w, shared.Accept{Version: site.version, ID: path.Base(site.data)})
+}
+
+func apiDelete(w http.ResponseWriter, name string) {
+	removed := removeApp(name)
+	if len(removed) == 0 {
+		apiError(w, http.StatusNotFound, "no such app: "+name)
+		return
+	}
+
+	data := map[string]bool{}
+	running := []*RunningSite{}
+	for _, site := range removed {
+		data[site.data] = true
+		lock.RLock()
+		if site.running != nil && !site.running.error {
+			running = append(running, site.running)
+		}
+		lock.RUnlock()
+		retireSite(site, "delete")
+		if len(site.certid) > 0 && !usesCertificate(site.certid) {
+			removeCertificate(site.certid)
+		}
+	}
+	journal(shared.Event{Type: shared.EventDeleted, App: name})
+	if err := removeSecrets(name); err != nil {
+		log.Print("error removing secrets: ", err)
+	}
+
+	// remove the files and logs once all instances exited
+	go func() {
+		for _, run := range running {
+			<-run.done
+		}
+		removeAppLog(name)
+		for dir := range data {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Print(err)
+			}
+		}
+		gcBlobs()
+	}()
+	apiReply(w, shared.Status{Ok: true})
+}
+
+func apiLogs(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	since, err := shared.ParseTime(query.Get("since"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "bad since: "+err.Error())
+		return
+	}
+	until, err := shared.ParseTime(query.Get("until"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "bad until: "+err.Error())
+		return
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	stream := query.Get("stream")
+	logs := getAppLog(name)
+
+	if query.Get("follow") == "" {
+		apiReply(w, logs.query(since, until, stream, limit))
+		return
+	}
+
+	// follow writes json lines, until the client goes away
+	lines, tail := logs.tail(since, until, stream, limit)
+	defer logs.untail(tail)
+	access := query.Get("access") != ""
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	for _, line := range lines {
+		encoder.Encode(line)
+	}
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case line := <-tail:
+			if line.Stream == "access" && !access {
+				continue
+			}
+			if stream != "" && line.Stream != stream {
+				continue
+			}
+			if err := encoder.Encode(line); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func apiEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since, err := shared.ParseTime(query.Get("since"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "bad since: "+err.Error())
+		return
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	events, err := queryJournal(query.Get("app"), query.Get("type"), since, limit)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "error reading events: "+err.Error())
+		return
+	}
+	apiReply(w, events)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lambdaroach/shared"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// limits for uploaded apps
+var maxFileSize = flag.Int64("maxfilesize", 100*1024*1024, "maximum size of a file of an app")
+var maxAppSize = flag.Int64("maxappsize", 1024*1024*1024, "maximum total size of the files of an app")
+var maxAppFiles = flag.Int("maxappfiles", 10000, "maximum number of files of an app")
+
+// safePath returns name inside of base, names like "../../etc/passwd" cannot escape base
+func safePath(base, name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return "", errors.New("bad file name: " + name)
+	}
+	return path.Join(base, clean), nil
+}
+
+// checkNoLinks checks none of the parent directories of file inside of base are symlinks, otherwise writing through
+// them, or creating relative symlinks in them, could escape base
+func checkNoLinks(base, file string) error {
+	dir := path.Dir(file)
+	for dir != base && strings.HasPrefix(dir, base+"/") {
+		stat, err := os.Lstat(dir)
+		if err == nil && stat.Mode()&os.ModeSymlink != 0 {
+			return errors.New("path contains a symlink: " + file[len(base):])
+		}
+		dir = path.Dir(dir)
+	}
+	return nil
+}
+
+// maximum number of symlinks followed resolving a target, like the kernel
+const maxLinks = 40
+
+// resolveLink resolves target relative to directory dir inside of base, following the symlinks already there, and
+// fails if it leaves base. Like the kernel, .. applies to where a symlink points, not to the symlink itself. A .. after
+// a file that does not exist yet is refused, a later symlink with that name could otherwise move the target out.
+func resolveLink(base, dir, target string) (string, error) {
+	if path.IsAbs(target) {
+		return "", errors.New("absolute symlink")
+	}
+	elems := strings.Split(target, "/")
+	missing := false
+	links := 0
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if missing {
+				return "", errors.New("symlink through missing directory")
+			}
+			if dir == base {
+				return "", errors.New("symlink outside of app")
+			}
+			dir = path.Dir(dir)
+			continue
+		}
+		next := path.Join(dir, elem)
+		stat, err := os.Lstat(next)
+		if err != nil {
+			missing = true
+		}
+		if err != nil || stat.Mode()&os.ModeSymlink == 0 {
+			dir = next
+			continue
+		}
+		links++
+		if links > maxLinks {
+			return "", errors.New("too many levels of symlinks")
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			return "", errors.New("absolute symlink")
+		}
+		elems = append(strings.Split(link, "/"), elems...)
+	}
+	return dir, nil
+}
+
+// writeLink creates a symlink, only if its target, through the symlinks already written, stays inside of base
+func writeLink(base, file, target string) error {
+	if _, err := resolveLink(base, path.Dir(file), target); err != nil {
+		return fmt.Errorf("%v: %s -> %s", err, file[len(base):], target)
+	}
+	return os.Symlink(target, file)
+}
+
+// archiveWriter writes the entries of an archive into base, and enforces the limits
+type archiveWriter struct {
+	base  string
+	files int
+	bytes int64
+}
+
+func (a *archiveWriter) path(name string) (string, error) {
+	a.files++
+	if a.files > *maxAppFiles {
+		return "", fmt.Errorf("too many files, maximum is: %d", *maxAppFiles)
+	}
+	file, err := safePath(a.base, name)
+	if err != nil {
+		return "", err
+	}
+	if err := checkNoLinks(a.base, file); err != nil {
+		return "", err
+	}
+	return file, os.MkdirAll(path.Dir(file), 0755)
+}
+
+func (a *archiveWriter) dir(name string, perm int) error {
+	file, err := a.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(file, cleanDirPerm(perm))
+	if os.IsExist(err) {
+		return os.Chmod(file, cleanDirPerm(perm))
+	}
+	return err
+}
+
+func (a *archiveWriter) file(name string, perm int, size int64, r io.Reader) error {
+	if size > *maxFileSize {
+		return errors.New("file size too large: " + name)
+	}
+	if a.bytes+size > *maxAppSize {
+		return fmt.Errorf("app too large, maximum is: %d bytes", *maxAppSize)
+	}
+	file, err := a.path(name)
+	if err != nil {
+		return err
+	}
+	// writing to a symlink would write to its target instead
+	if stat, err := os.Lstat(file); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+		return errors.New("file is a symlink: " + name)
+	}
+	written, err := writeFile(a.base, shared.FileMessage{Name: file[len(a.base):], Perm: perm}, io.LimitReader(r, size))
+	a.bytes += written
+	return err
+}
+
+func (a *archiveWriter) symlink(name, target string) error {
+	file, err := a.path(name)
+	if err != nil {
+		return err
+	}
+	return writeLink(a.base, file, target)
+}
+
+func (a *archiveWriter) hardlink(name, target string) error {
+	file, err := a.path(name)
+	if err != nil {
+		return err
+	}
+	source, err := safePath(a.base, target)
+	if err != nil {
+		return err
+	}
+	if err := checkNoLinks(a.base, source); err != nil {
+		return err
+	}
+	// a hard link to a relative symlink would point elsewhere from its new directory
+	if stat, err := os.Lstat(source); err == nil && !stat.Mode().IsRegular() {
+		return errors.New("hard link to a symlink or directory: " + name + " -> " + target)
+	}
+	return os.Link(source, file)
+}
+
+func (a *archiveWriter) tar(r io.Reader) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if path.Clean("/"+header.Name) == "/" {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = a.dir(header.Name, int(header.Mode))
+		case tar.TypeReg:
+			err = a.file(header.Name, int(header.Mode), header.Size, archive)
+		case tar.TypeSymlink:
+			err = a.symlink(header.Name, header.Linkname)
+		case tar.TypeLink:
+			err = a.hardlink(header.Name, header.Linkname)
+		default:
+			// skip devices, fifos and such
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (a *archiveWriter) zip(r io.Reader) error {
+	// zip needs random access, so spool it into a temporary file first
+	tmp, err := ioutil.TempFile("", "lambdaroach-zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, io.LimitReader(r, *maxAppSize-a.bytes+1))
+	if err != nil {
+		return err
+	}
+	if size > *maxAppSize-a.bytes {
+		return fmt.Errorf("app too large, maximum is: %d bytes", *maxAppSize)
+	}
+
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return err
+	}
+	for _, entry := range archive.File {
+		if path.Clean("/"+entry.Name) == "/" {
+			continue
+		}
+		mode := entry.Mode()
+		if mode.IsDir() {
+			if err := a.dir(entry.Name, int(mode.Perm())); err != nil {
+				return err
+			}
+			continue
+		}
+		if mode&os.ModeSymlink == 0 && !mode.IsRegular() {
+			continue
+		}
+		if entry.UncompressedSize64 > uint64(*maxFileSize) {
+			return errors.New("file size too large: " + entry.Name)
+		}
+
+		in, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		if mode&os.ModeSymlink != 0 {
+			var target []byte
+			target, err = ioutil.ReadAll(io.LimitReader(in, 4096))
+			if err == nil {
+				err = a.symlink(entry.Name, string(target))
+			}
+		} else {
+			err = a.file(entry.Name, int(mode.Perm()), int64(entry.UncompressedSize64), in)
+		}
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractArchive writes the files of a zip, or of an optionally gzip or zstd compressed tar, into base, the format
+// is detected from the first bytes. The limits apply to the files and bytes of the app so far, it returns the totals.
+func extractArchive(base string, files int, size int64, r io.Reader) (int, int64, error) {
+	var err error
+	a := &archiveWriter{base: base, files: files, bytes: size}
+	in := bufio.NewReader(r)
+	magic, _ := in.Peek(4)
+	switch {
+	case hasMagic(magic, 0x50, 0x4b, 0x03, 0x04):
+		err = a.zip(in)
+	case hasMagic(magic, 0x1f, 0x8b):
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(in)
+		if err == nil {
+			err = a.tar(gz)
+		}
+	case hasMagic(magic, 0x28, 0xb5, 0x2f, 0xfd):
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(in)
+		if err == nil {
+			err = a.tar(zr)
+			zr.Close()
+		}
+	default:
+		err = a.tar(in)
+	}
+	return a.files, a.bytes, err
+}
+
+func hasMagic(b []byte, magic ...byte) bool {
+	return bytes.HasPrefix(b, magic)
+}
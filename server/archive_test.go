@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	data     string // contents of a file, or target of a link
+}
+
+func makeTar(entries []tarEntry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644}
+		switch e.typeflag {
+		case tar.TypeReg:
+			header.Size = int64(len(e.data))
+		case tar.TypeDir:
+			header.Mode = 0755
+		default:
+			header.Linkname = e.data
+		}
+		if err := w.WriteHeader(header); err != nil {
+			panic(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			w.Write([]byte(e.data))
+		}
+	}
+	w.Close()
+	return buf
+}
+
+// extractDir returns the base to extract into, inside a parent with a file that must not be reachable
+func extractDir(t *testing.T) string {
+	parent := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(parent, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base := path.Join(parent, "app")
+	if err := os.Mkdir(base, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+func TestExtractArchive(t *testing.T) {
+	base := extractDir(t)
+	files, size, err := extractArchive(base, 0, 0, makeTar([]tarEntry{
+		{"./", tar.TypeDir, ""},
+		{"dir/", tar.TypeDir, ""},
+		{"dir/a.txt", tar.TypeReg, "hello"},
+		{"b.txt", tar.TypeReg, "world!"},
+		{"dir/link", tar.TypeSymlink, "../b.txt"},
+		{"dir/up", tar.TypeSymlink, ".."},
+		{"hard", tar.TypeLink, "dir/a.txt"},
+		{"../../escaped.txt", tar.TypeReg, "cleaned"},
+	}))
+	if err != nil || files != 7 || size != 18 {
+		t.Fatal("oeps", files, size, err)
+	}
+	for name, contents := range map[string]string{"dir/a.txt": "hello", "dir/link": "world!", "dir/up/b.txt": "world!", "hard": "hello", "escaped.txt": "cleaned"} {
+		data, err := ioutil.ReadFile(path.Join(base, name))
+		if err != nil || string(data) != contents {
+			t.Fatal("oeps", name, string(data), err)
+		}
+	}
+	if _, err := os.Stat(path.Join(base, "../escaped.txt")); err == nil {
+		t.Fatal("oeps")
+	}
+}
+
+func TestExtractArchiveLinks(t *testing.T) {
+	bad := [][]tarEntry{
+		{{"abs", tar.TypeSymlink, "/etc/passwd"}},
+		{{"up", tar.TypeSymlink, ".."}},
+		{{"dir/", tar.TypeDir, ""}, {"dir/up", tar.TypeSymlink, "../.."}},
+		// each link stays inside, but through the first, the second does not
+		{{"up", tar.TypeSymlink, "."}, {"x", tar.TypeSymlink, "up/.."}},
+		// dangling at first, escaping once the link it passes through exists
+		{{"x", tar.TypeSymlink, "up/.."}, {"up", tar.TypeSymlink, "."}},
+		{{"a", tar.TypeSymlink, "b"}, {"b", tar.TypeSymlink, "a/.."}},
+		// writing through links
+		{{"dir", tar.TypeSymlink, "."}, {"dir/file", tar.TypeReg, "x"}},
+		{{"file", tar.TypeSymlink, "other"}, {"file", tar.TypeReg, "x"}},
+		// a hard link to a symlink resolves from its own directory
+		{{"dir/", tar.TypeDir, ""}, {"dir/up", tar.TypeSymlink, ".."}, {"up", tar.TypeLink, "dir/up"}},
+	}
+	for i, entries := range bad {
+		base := extractDir(t)
+		if _, _, err := extractArchive(base, 0, 0, makeTar(entries)); err == nil {
+			t.Fatal("oeps", i)
+		}
+		if _, err := os.Stat(path.Join(base, "x/secret")); err == nil {
+			t.Fatal("oeps", i)
+		}
+	}
+
+	// a loop is only a problem when it is followed
+	base := extractDir(t)
+	_, _, err := extractArchive(base, 0, 0, makeTar([]tarEntry{{"a", tar.TypeSymlink, "b"}, {"b", tar.TypeSymlink, "a"}, {"c", tar.TypeSymlink, "a/x"}}))
+	if err == nil || !strings.Contains(err.Error(), "too many levels") {
+		t.Fatal("oeps", err)
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	defer func(files int, size, appSize int64) {
+		*maxAppFiles, *maxFileSize, *maxAppSize = files, size, appSize
+	}(*maxAppFiles, *maxFileSize, *maxAppSize)
+	*maxAppFiles, *maxFileSize, *maxAppSize = 3, 10, 15
+
+	ok := []tarEntry{{"a", tar.TypeReg, "0123456789"}, {"b", tar.TypeReg, "01234"}}
+	if _, _, err := extractArchive(extractDir(t), 0, 0, makeTar(ok)); err != nil {
+		t.Fatal("oeps", err)
+	}
+	bad := [][]tarEntry{
+		{{"a", tar.TypeReg, "0123456789x"}},
+		{{"a", tar.TypeReg, "0123456789"}, {"b", tar.TypeReg, "012345"}},
+		{{"a", tar.TypeDir, ""}, {"b", tar.TypeDir, ""}, {"c", tar.TypeDir, ""}, {"d", tar.TypeDir, ""}},
+	}
+	for i, entries := range bad {
+		if _, _, err := extractArchive(extractDir(t), 0, 0, makeTar(entries)); err == nil {
+			t.Fatal("oeps", i)
+		}
+	}
+
+	// the limits are for the whole app, not per archive of an upload
+	base := extractDir(t)
+	files, size, err := extractArchive(base, 0, 0, makeTar([]tarEntry{{"a", tar.TypeReg, "0123456789"}}))
+	if err != nil || files != 1 || size != 10 {
+		t.Fatal("oeps", files, size, err)
+	}
+	if _, _, err := extractArchive(base, files, size, makeTar([]tarEntry{{"b", tar.TypeReg, "012345"}})); err == nil {
+		t.Fatal("oeps")
+	}
+	if _, _, err := extractArchive(base, 3, 0, makeTar([]tarEntry{{"c", tar.TypeReg, "0"}})); err == nil {
+		t.Fatal("oeps")
+	}
+
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	f, _ := w.Create("big")
+	f.Write([]byte("0123456789x"))
+	w.Close()
+	if _, _, err := extractArchive(extractDir(t), 0, 0, buf); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatal("oeps", err)
+	}
+}
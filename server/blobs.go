@@ -0,0 +1,415 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"lambdaroach/shared"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var blobDir = flag.String("blobdir", "blobs", "directory for the content addressed store of uploaded files")
+
+// blobs are only removed when no app version links to them anymore, and they are older than blobMinAge, so they
+// are not removed while an upload uses them, the same goes for partial blobs of interrupted uploads
+const blobMinAge = time.Hour
+
+// gc takes blobLock for writing, uploads for reading while they check and mark the blobs they use
+var blobLock = sync.RWMutex{}
+
+// blobs used by uploads in progress, by hash, gc leaves them alone, guarded by blobUploadsLock
+var blobsInUse = map[string]int{}
+
+// useBlobs marks hashes as used by an upload, it must hold blobLock, release undoes it
+func useBlobs(hashes []string) (release func()) {
+	blobUploadsLock.Lock()
+	defer blobUploadsLock.Unlock()
+	for _, hash := range hashes {
+		blobsInUse[hash]++
+	}
+	return func() {
+		blobUploadsLock.Lock()
+		defer blobUploadsLock.Unlock()
+		for _, hash := range hashes {
+			blobsInUse[hash]--
+			if blobsInUse[hash] == 0 {
+				delete(blobsInUse, hash)
+			}
+		}
+	}
+}
+
+func blobInUse(hash string) bool {
+	blobUploadsLock.Lock()
+	defer blobUploadsLock.Unlock()
+	return blobsInUse[hash] > 0
+}
+
+// blobs whose hash was checked, with their size, times and inode then, they are only hashed again once changed
+var checkedBlobsLock = sync.Mutex{}
+var checkedBlobs = map[string]string{}
+
+// blobState identifies the contents of a file without reading it, ctime cannot be set back by an app
+func blobState(stat os.FileInfo) string {
+	state := fmt.Sprintf("%d %d", stat.Size(), stat.ModTime().UnixNano())
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		state += fmt.Sprintf(" %d %d %d", sys.Ino, sys.Ctim.Sec, sys.Ctim.Nsec)
+	}
+	return state
+}
+
+func blobPath(hash string) string {
+	return path.Join(*blobDir, hash[:2], hash)
+}
+
+// checkBlobDir checks the blob store is on the same file system as the app versions. Blobs are hard linked into apps,
+// otherwise they are copied, and gc removes blobs without links after an hour, the store would only double disk use.
+func checkBlobDir() error {
+	devices := []uint64{}
+	for _, dir := range []string{*blobDir, *appDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		stat, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		sys, ok := stat.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		devices = append(devices, uint64(sys.Dev))
+	}
+	if devices[0] != devices[1] {
+		return fmt.Errorf("-blobdir %s and -appdir %s must be on the same file system, blobs are hard linked into apps",
+			*blobDir, *appDir)
+	}
+	return nil
+}
+
+// blobPerm returns the mode of a stored blob of a file with permissions perm, blobs are hard linked into apps, and
+// are read-only so an app cannot change them for other versions
+func blobPerm(perm int) os.FileMode {
+	return cleanFilePerm(perm) &^ 0222
+}
+
+// checkBlob checks blob hash is stored and still has that hash. An app running as root can change its hard links
+// anyway, a changed blob is removed so it is uploaded again.
+func checkBlob(hash string) bool {
+	blob := blobPath(hash)
+	stat, err := os.Stat(blob)
+	if err != nil {
+		return false
+	}
+	checkedBlobsLock.Lock()
+	checked := checkedBlobs[hash] == blobState(stat)
+	checkedBlobsLock.Unlock()
+	if checked {
+		return true
+	}
+
+	if stored, err := shared.HashFile(blob); err != nil || stored != hash {
+		log.Print("blobs: removing changed blob: ", hash)
+		if err := os.Remove(blob); err != nil {
+			log.Print("blobs: ", err)
+		}
+		return false
+	}
+	// blobs stored by older versions are writable
+	if stat.Mode().Perm()&0222 != 0 {
+		if err := os.Chmod(blob, stat.Mode()&^0222); err != nil {
+			log.Print("blobs: ", err)
+		}
+		if stat, err = os.Stat(blob); err != nil {
+			return false
+		}
+	}
+	checkedBlobsLock.Lock()
+	checkedBlobs[hash] = blobState(stat)
+	checkedBlobsLock.Unlock()
+	return true
+}
+
+// blobs being written by an upload, so two uploads don't append to the same partial blob
+var blobUploadsLock = sync.Mutex{}
+var blobUploads = map[string]bool{}
+
+// partialBlob returns the bytes of blob hash received by an interrupted upload
+func partialBlob(hash string) int64 {
+	stat, err := os.Stat(blobPath(hash) + ".partial")
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+// writeBlob stores the bytes of r from offset up to size in the blob store, and once complete checks they match hash.
+// If the upload is interrupted the bytes received are kept, so the upload can be resumed.
+func writeBlob(hash string, size, offset int64, perm int, r io.Reader) error {
+	if err := shared.CheckHash(hash); err != nil {
+		return err
+	}
+	blobUploadsLock.Lock()
+	if blobUploads[hash] {
+		blobUploadsLock.Unlock()
+		return errors.New("blob is being uploaded by another upload: " + hash)
+	}
+	blobUploads[hash] = true
+	blobUploadsLock.Unlock()
+	defer func() {
+		blobUploadsLock.Lock()
+		delete(blobUploads, hash)
+		blobUploadsLock.Unlock()
+	}()
+
+	file := blobPath(hash)
+	partial := file + ".partial"
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	if offset != partialBlob(hash) {
+		return fmt.Errorf("bad offset of blob: %s %d", hash, offset)
+	}
+	out, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	written, err := io.Copy(out, io.LimitReader(r, size-offset))
+	if err != nil {
+		return err
+	}
+	if written != size-offset {
+		return io.ErrUnexpectedEOF
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// the hash is of the whole file, including what was received before resuming
+	received, err := shared.HashFile(partial)
+	if err != nil {
+		return err
+	}
+	if received != hash {
+		os.Remove(partial)
+		return errors.New("hash mismatch of blob: " + hash)
+	}
+	if err := os.Chmod(partial, blobPerm(perm)); err != nil {
+		return err
+	}
+	return os.Rename(partial, file)
+}
+
+// linkBlob puts the blob at file, hard linked if the blob has the same permissions apart from being read-only, and is
+// on the same file system, otherwise copied
+func linkBlob(hash, file string, perm int) error {
+	blob := blobPath(hash)
+	stat, err := os.Stat(blob)
+	if err != nil {
+		return err
+	}
+	if stat.Mode().Perm() == blobPerm(perm).Perm() && os.Link(blob, file) == nil {
+		return nil
+	}
+
+	in, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = writeFile(path.Dir(file), shared.FileMessage{Name: path.Base(file), Perm: perm}, in)
+	return err
+}
+
+// receiveManifest reads the manifest of an incremental upload, asks for the missing blobs, and puts all files in base
+func receiveManifest(base string, c *shared.Conn) (files int, bytes int64, digest string, err error) {
+	var manifest shared.Manifest
+	err = c.ReadJSON(&manifest)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("error reading manifest: %v", err)
+	}
+	if len(manifest.Files) > *maxAppFiles {
+		return 0, 0, "", fmt.Errorf("too many files, maximum is: %d", *maxAppFiles)
+	}
+
+	// the blobs are checked and marked in use holding the lock, so gc does not remove them during the upload, the lock
+	// itself is not held while reading from the client, gc waiting for a stalled upload would block other uploads
+	blobLock.RLock()
+	missing := shared.Missing{Hashes: []string{}, Partial: map[string]int64{}}
+	sizes := map[string]int64{}
+	perms := map[string]int{}
+	hashes := []string{}
+	for _, file := range manifest.Files {
+		if file.Size < 0 {
+			blobLock.RUnlock()
+			return 0, 0, "", errors.New("negative file size: " + file.Name)
+		}
+		if shared.EndsWith(file.Name, "/") {
+			continue
+		}
+		if err := shared.CheckHash(file.Hash); err != nil {
+			blobLock.RUnlock()
+			return 0, 0, "", err
+		}
+		if file.Size > *maxFileSize {
+			blobLock.RUnlock()
+			return 0, 0, "", errors.New("file size too large: " + file.Name)
+		}
+		bytes += file.Size
+		if bytes > *maxAppSize {
+			blobLock.RUnlock()
+			return 0, 0, "", fmt.Errorf("app too large, maximum is: %d bytes", *maxAppSize)
+		}
+		if _, ok := sizes[file.Hash]; !ok {
+			hashes = append(hashes, file.Hash)
+			if !checkBlob(file.Hash) {
+				missing.Hashes = append(missing.Hashes, file.Hash)
+				if offset := partialBlob(file.Hash); offset >= file.Size {
+					os.Remove(blobPath(file.Hash) + ".partial")
+				} else if offset > 0 {
+					missing.Partial[file.Hash] = offset
+				}
+			}
+		}
+		sizes[file.Hash] = file.Size
+		perms[file.Hash] = file.Perm
+	}
+	defer useBlobs(hashes)()
+	blobLock.RUnlock()
+
+	err = c.WriteJSON(missing)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	log.Print("manifest files: ", len(manifest.Files), ", missing: ", len(missing.Hashes), ", resuming: ", len(missing.Partial))
+
+	wanted := map[string]bool{}
+	for _, hash := range missing.Hashes {
+		wanted[hash] = true
+	}
+	var received int64
+	for {
+		var file shared.FileMessage
+		err = c.ReadJSON(&file)
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("error reading file message: %v", err)
+		}
+		if file.Size < 0 {
+			return 0, 0, "", errors.New("negative file size")
+		}
+		if file.Hash == "" && file.Size == 0 {
+			break
+		}
+		if !wanted[file.Hash] || int64(file.Size) != sizes[file.Hash] || file.Offset != missing.Partial[file.Hash] {
+			return 0, 0, "", errors.New("unexpected blob: " + file.Hash)
+		}
+		delete(wanted, file.Hash)
+		size := int64(file.Size) - file.Offset
+		err = writeBlob(file.Hash, int64(file.Size), file.Offset, perms[file.Hash], c.Data(size))
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("error writing blob: %v", err)
+		}
+		received += size
+	}
+	if len(wanted) > 0 {
+		return 0, 0, "", fmt.Errorf("missing blobs: %d", len(wanted))
+	}
+	log.Print("received blobs: ", len(missing.Hashes), ", total bytes: ", received)
+
+	for _, file := range manifest.Files {
+		name, err := safePath(base, file.Name)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		if err := checkNoLinks(base, name); err != nil {
+			return 0, 0, "", err
+		}
+		if shared.EndsWith(file.Name, "/") {
+			err = os.MkdirAll(name, cleanDirPerm(file.Perm))
+		} else {
+			err = os.MkdirAll(path.Dir(name), 0755)
+			if err == nil {
+				err = linkBlob(file.Hash, name, file.Perm)
+			}
+			files++
+		}
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("error creating file: %v", err)
+		}
+	}
+	return files, bytes, manifest.Digest, nil
+}
+
+// manifestDir returns the Manifest of the regular files in base
+func manifestDir(base string) (shared.Manifest, error) {
+	manifest := shared.Manifest{Files: []shared.ManifestFile{}}
+	err := filepath.Walk(base, func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		hash, err := shared.HashFile(name)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, shared.ManifestFile{
+			Name: name[len(base)+1:],
+			Size: info.Size(),
+			Perm: int(info.Mode().Perm()),
+			Hash: hash,
+		})
+		return nil
+	})
+	manifest.Digest = shared.Digest(manifest.Files)
+	return manifest, err
+}
+
+// digestDir returns the shared.Digest of the regular files in base
+func digestDir(base string) (string, error) {
+	manifest, err := manifestDir(base)
+	return manifest.Digest, err
+}
+
+// gcBlobs removes the blobs that are not linked from any app version anymore
+func gcBlobs() {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	blobs, err := filepath.Glob(path.Join(*blobDir, "*", "*"))
+	if err != nil {
+		log.Print("blobs: ", err)
+		return
+	}
+	removed := 0
+	for _, blob := range blobs {
+		stat, err := os.Lstat(blob)
+		if err != nil || time.Since(stat.ModTime()) < blobMinAge {
+			continue
+		}
+		if sys, ok := stat.Sys().(*syscall.Stat_t); !ok || sys.Nlink > 1 {
+			continue
+		}
+		if blobInUse(strings.TrimSuffix(path.Base(blob), ".partial")) {
+			continue
+		}
+		if err := os.Remove(blob); err != nil {
+			log.Print("blobs: ", err)
+			continue
+		}
+		checkedBlobsLock.Lock()
+		delete(checkedBlobs, path.Base(blob))
+		checkedBlobsLock.Unlock()
+		removed++
+	}
+	if removed > 0 {
+		log.Print("blobs: removed unused: ", removed)
+	}
+}
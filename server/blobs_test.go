@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"lambdaroach/shared"
+)
+
+// storeBlob writes contents to the blob store of dir, older than blobMinAge, and returns its hash
+func storeBlob(t *testing.T, dir, contents string) string {
+	*blobDir = dir
+	sum := sha256.Sum256([]byte(contents))
+	hash := hex.EncodeToString(sum[:])
+	if err := os.MkdirAll(path.Dir(blobPath(hash)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blobPath(hash), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * blobMinAge)
+	if err := os.Chtimes(blobPath(hash), old, old); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestBlobs(t *testing.T) {
+	defer func(dir string) { *blobDir = dir }(*blobDir)
+	dir := t.TempDir()
+	hash := storeBlob(t, dir, "hello")
+
+	// checked blobs are made read-only
+	if !checkBlob(hash) {
+		t.Fatal("oeps")
+	}
+	if stat, _ := os.Stat(blobPath(hash)); stat.Mode().Perm() != 0444 {
+		t.Fatal("oeps", stat.Mode())
+	}
+	if !checkBlob(hash) {
+		t.Fatal("oeps")
+	}
+
+	// a changed blob is removed, even with its old modification time
+	stat, _ := os.Stat(blobPath(hash))
+	os.Chmod(blobPath(hash), 0644)
+	if err := ioutil.WriteFile(blobPath(hash), []byte("HELLO"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(blobPath(hash), stat.ModTime(), stat.ModTime())
+	if checkBlob(hash) || hasFile(blobPath(hash)) {
+		t.Fatal("oeps")
+	}
+
+	// gc leaves blobs in use by an upload alone
+	used := storeBlob(t, dir, "used")
+	unused := storeBlob(t, dir, "unused")
+	release := useBlobs([]string{used})
+	gcBlobs()
+	if !hasFile(blobPath(used)) || hasFile(blobPath(unused)) {
+		t.Fatal("oeps")
+	}
+	release()
+	gcBlobs()
+	if hasFile(blobPath(used)) {
+		t.Fatal("oeps")
+	}
+}
+
+func hasFile(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func TestReceiveManifestSizes(t *testing.T) {
+	defer func(dir string) { *blobDir = dir }(*blobDir)
+	*blobDir = t.TempDir()
+	hash := storeBlob(t, *blobDir, "hello")
+	bad := []shared.Manifest{
+		{Files: []shared.ManifestFile{{Name: "dir/", Size: -1}}},
+		{Files: []shared.ManifestFile{{Name: "a", Hash: hash, Size: -1}}},
+	}
+	for i, manifest := range bad {
+		buf := &bytes.Buffer{}
+		out := shared.NewConn(nil, buf)
+		out.WriteJSON(manifest)
+		out.WriteJSON(shared.FileMessage{})
+		c := shared.NewConn(bufio.NewReader(buf), ioutil.Discard)
+		if _, _, _, err := receiveManifest(t.TempDir(), c); err == nil {
+			t.Fatal("oeps", i)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"lambdaroach/shared"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// encoders are reused, creating them allocates a lot. Responses are compressed on the fly, so gzip uses its fastest
+// level, and brotli level 4, which is about as fast and still compresses better.
+var gzipWriters = sync.Pool{New: func() interface{} {
+	w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+	return w
+}}
+var brotliWriters = sync.Pool{New: func() interface{} {
+	return brotli.NewWriterLevel(nil, 4)
+}}
+
+// encoder is a gzip or brotli writer
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// countWriter counts the bytes written to the client
+type countWriter struct {
+	w     io.Writer
+	bytes int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	written, err := c.w.Write(p)
+	c.bytes += int64(written)
+	return written, err
+}
+
+// compressWriter compresses responses on the fly, when the client accepts it, the content type is compressible, and
+// the app did not encode the response itself. Responses of unknown length are buffered until they reach the minimum
+// size, so small responses are sent as is.
+type compressWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	options  shared.Compress
+	out      *countWriter
+	status   int    // 0 until WriteHeader
+	encoding string // chosen encoding, empty to send as is
+	buf      []byte // buffered until deciding to compress
+	decided  bool   // headers are written
+	enc      encoder
+}
+
+func newCompressWriter(w http.ResponseWriter, r *http.Request, options shared.Compress) *compressWriter {
+	return &compressWriter{ResponseWriter: w, r: r, options: options, out: &countWriter{w: w}}
+}
+
+// addVary adds a value to the Vary header, unless it is already there
+func addVary(h http.Header, value string) {
+	for _, vary := range h["Vary"] {
+		for _, v := range strings.Split(vary, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), value) || strings.TrimSpace(v) == "*" {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// compressible checks if a response can be compressed, whether the client accepts it or not
+func (w *compressWriter) compressible(status int, h http.Header) bool {
+	if w.r.Method == "HEAD" || status < 200 || status == http.StatusNoContent || status == http.StatusPartialContent ||
+		status == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	return w.options.Compressible(h.Get("Content-Type"))
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	h := w.Header()
+	if !w.compressible(status, h) {
+		w.decide(false)
+		return
+	}
+
+	// the response depends on Accept-Encoding, also for clients that don't accept any
+	addVary(h, "Accept-Encoding")
+	for _, encoding := range w.options.Preference() {
+		if acceptsEncoding(w.r, encoding) {
+			w.encoding = encoding
+			break
+		}
+	}
+	if w.encoding == "" {
+		w.decide(false)
+		return
+	}
+	if size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		w.decide(size >= int64(w.options.Threshold()))
+	}
+	// else the size is unknown, buffer until it reaches the threshold, or the response ends
+}
+
+// decide writes the headers, and then the buffered bytes, compressed or as is
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		h := w.Header()
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		if etag := h.Get("ETag"); etag != "" && !shared.StartsWith(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		if w.encoding == "br" {
+			bw := brotliWriters.Get().(*brotli.Writer)
+			bw.Reset(w.out)
+			w.enc = bw
+		} else {
+			gw := gzipWriters.Get().(*gzip.Writer)
+			gw.Reset(w.out)
+			w.enc = gw
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.write(buf)
+	return err
+}
+
+func (w *compressWriter) write(p []byte) (int, error) {
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.out.Write(p)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) >= w.options.Threshold() {
+			if err := w.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	return w.write(p)
+}
+
+// Flush sends what was written so far, compressed if the response is compressible, for streaming responses
+func (w *compressWriter) Flush() {
+	if w.status != 0 && !w.decided {
+		w.decide(true)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("connection cannot be hijacked")
+}
+
+// Close ends the response, small buffered responses are sent as is, and returns the bytes written to the client
+func (w *compressWriter) Close() (int64, error) {
+	var err error
+	if w.status != 0 && !w.decided {
+		err = w.decide(false)
+	}
+	if w.enc != nil {
+		if cerr := w.enc.Close(); err == nil {
+			err = cerr
+		}
+		switch enc := w.enc.(type) {
+		case *gzip.Writer:
+			enc.Reset(nil)
+			gzipWriters.Put(enc)
+		case *brotli.Writer:
+			enc.Reset(nil)
+			brotliWriters.Put(enc)
+		}
+		w.enc = nil
+	}
+	return w.out.bytes, err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+
+	"lambdaroach/shared"
+)
+
+// compressed is a response written through a compressWriter
+type compressed struct {
+	status int
+	header http.Header
+	body   string // decoded
+	bytes  int64  // written to the client
+}
+
+// compressResponse writes a response with header, status and body through a compressWriter for a request with
+// Accept-Encoding accept
+func compressResponse(t *testing.T, options shared.Compress, method, accept string, header http.Header, status int, body string) compressed {
+	r := httptest.NewRequest(method, "/", nil)
+	if accept != "" {
+		r.Header.Set("Accept-Encoding", accept)
+	}
+	rec := httptest.NewRecorder()
+	w := newCompressWriter(rec, r, options)
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+	// in parts, like a proxied response
+	for len(body) > 0 {
+		n := len(body)
+		if n > 100 {
+			n = 100
+		}
+		w.Write([]byte(body[:n]))
+		body = body[n:]
+	}
+	written, err := w.Close()
+	if err != nil || written != int64(rec.Body.Len()) {
+		t.Fatal("oeps", written, rec.Body.Len(), err)
+	}
+
+	var in io.Reader = rec.Body
+	switch rec.Header().Get("Content-Encoding") {
+	case "gzip":
+		gr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal("oeps", err)
+		}
+		in = gr
+	case "br":
+		in = brotli.NewReader(rec.Body)
+	}
+	decoded, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatal("oeps", err)
+	}
+	return compressed{rec.Code, rec.Header(), string(decoded), written}
+}
+
+func TestCompressWriter(t *testing.T) {
+	big := strings.Repeat("hello compression ", 200)
+	text := func(extra ...string) http.Header {
+		h := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+		for i := 0; i+1 < len(extra); i += 2 {
+			h.Set(extra[i], extra[i+1])
+		}
+		return h
+	}
+
+	tests := []struct {
+		name     string
+		options  shared.Compress
+		method   string
+		accept   string
+		header   http.Header
+		status   int
+		body     string
+		encoding string
+		vary     bool
+	}{
+		{"br preferred", shared.Compress{}, "GET", "gzip, deflate, br", text(), 200, big, "br", true},
+		{"gzip", shared.Compress{}, "GET", "gzip", text(), 200, big, "gzip", true},
+		{"configured preference", shared.Compress{Encodings: []string{"gzip", "br"}}, "GET", "br, gzip", text(), 200, big, "gzip", true},
+		{"only configured encodings", shared.Compress{Encodings: []string{"br"}}, "GET", "gzip", text(), 200, big, "", true},
+		{"no accept-encoding", shared.Compress{}, "GET", "", text(), 200, big, "", true},
+		{"refused with q=0", shared.Compress{}, "GET", "br;q=0, gzip;q=0", text(), 200, big, "", true},
+		{"below minsize", shared.Compress{}, "GET", "gzip", text(), 200, "small", "", true},
+		{"configured minsize", shared.Compress{MinSize: 10}, "GET", "gzip", text(), 200, "not so small", "gzip", true},
+		{"content-length below minsize", shared.Compress{}, "GET", "gzip", text("Content-Length", "5"), 200, "small", "", true},
+		{"content-length", shared.Compress{}, "GET", "gzip", text("Content-Length", "3600"), 200, big, "gzip", true},
+		{"json", shared.Compress{}, "GET", "gzip", http.Header{"Content-Type": {"application/json"}}, 200, big, "gzip", true},
+		{"image", shared.Compress{}, "GET", "gzip", http.Header{"Content-Type": {"image/png"}}, 200, big, "", false},
+		{"no content-type", shared.Compress{}, "GET", "gzip", http.Header{}, 200, big, "", false},
+		{"configured types", shared.Compress{Types: []string{"image/*"}}, "GET", "gzip", http.Header{"Content-Type": {"image/png"}}, 200, big, "gzip", true},
+		{"no-transform", shared.Compress{}, "GET", "gzip", text("Cache-Control", "public, no-transform"), 200, big, "", false},
+		{"range", shared.Compress{}, "GET", "gzip", text("Content-Range", "bytes 0-3599/5000"), 206, big, "", false},
+		{"not modified", shared.Compress{}, "GET", "gzip", text(), 304, "", "", false},
+		{"no content", shared.Compress{}, "GET", "gzip", text(), 204, "", "", false},
+		{"head", shared.Compress{}, "HEAD", "gzip", text(), 200, "", "", false},
+		{"error page", shared.Compress{}, "GET", "gzip", text(), 404, big, "gzip", true},
+	}
+	for _, test := range tests {
+		res := compressResponse(t, test.options, test.method, test.accept, test.header, test.status, test.body)
+		if res.status != test.status || res.body != test.body || res.header.Get("Content-Encoding") != test.encoding {
+			t.Fatal("oeps", test.name, res.status, res.header)
+		}
+		if (res.header.Get("Vary") == "Accept-Encoding") != test.vary {
+			t.Fatal("oeps", test.name, res.header)
+		}
+		if test.encoding != "" && (res.header.Get("Content-Length") != "" || test.body == big && res.bytes >= int64(len(big))) {
+			t.Fatal("oeps", test.name, res.header, res.bytes)
+		}
+	}
+
+	// an app that encoded the response itself
+	encoded := &bytes.Buffer{}
+	gw := gzip.NewWriter(encoded)
+	gw.Write([]byte(big))
+	gw.Close()
+	res := compressResponse(t, shared.Compress{}, "GET", "br", text("Content-Encoding", "gzip"), 200, encoded.String())
+	if res.body != big || res.header.Get("Content-Encoding") != "gzip" || res.header.Get("Vary") != "" {
+		t.Fatal("oeps", res.header)
+	}
+
+	// strong etags become weak, ranges of the encoded response are not supported, vary is added to
+	res = compressResponse(t, shared.Compress{}, "GET", "gzip", text("ETag", `"abc"`, "Accept-Ranges", "bytes", "Vary", "Origin"), 200, big)
+	if res.header.Get("ETag") != `W/"abc"` || res.header.Get("Accept-Ranges") != "" || strings.Join(res.header["Vary"], ",") != "Origin,Accept-Encoding" {
+		t.Fatal("oeps", res.header)
+	}
+	res = compressResponse(t, shared.Compress{}, "GET", "gzip", text("ETag", `W/"abc"`, "Vary", "accept-encoding"), 200, big)
+	if res.header.Get("ETag") != `W/"abc"` || strings.Join(res.header["Vary"], ",") != "accept-encoding" {
+		t.Fatal("oeps", res.header)
+	}
+	// uncompressed responses keep their etag
+	res = compressResponse(t, shared.Compress{}, "GET", "", text("ETag", `"abc"`), 200, big)
+	if res.header.Get("ETag") != `"abc"` {
+		t.Fatal("oeps", res.header)
+	}
+}
+
+func TestCompressWriterFlush(t *testing.T) {
+	// streaming responses are compressed from the first flush, even when small
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	w := newCompressWriter(rec, r, shared.Compress{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Write([]byte("data: 1\n\n"))
+	w.Flush()
+	if !rec.Flushed || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("oeps", rec.Header())
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal("oeps", err)
+	}
+	buf := make([]byte, 9)
+	if _, err := io.ReadFull(gr, buf); err != nil || string(buf) != "data: 1\n\n" {
+		t.Fatal("oeps", string(buf), err)
+	}
+	w.Write([]byte("data: 2\n\n"))
+	if _, err := w.Close(); err != nil {
+		t.Fatal("oeps", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"lambdaroach/shared"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var eventsFile = flag.String("events", "events.log", "file for the journal of app lifecycle events, rotated like app logs")
+
+var journalLock = sync.Mutex{}
+var journalFile = rotatingFile{}
+
+// journal appends an event to the journal, as a json line
+func journal(event shared.Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		log.Print("journal: ", err)
+		return
+	}
+
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	journalFile.name = *eventsFile
+	if _, err := journalFile.Write(append(bytes, '\n')); err != nil {
+		log.Print("journal: ", err)
+	}
+}
+
+// siteEvent is a shortcut to journal an event about a site and optionally one of its instances
+func siteEvent(kind string, site *Site, run *RunningSite, msg string) {
+	event := shared.Event{Type: kind, App: site.id, Version: site.version, Msg: msg}
+	if run != nil {
+		event.Instance = run.id
+	}
+	journal(event)
+}
+
+// queryJournal reads the journal, including the rotated files, returns matching events oldest first
+func queryJournal(app, kind string, since time.Time, limit int) ([]shared.Event, error) {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	res := []shared.Event{}
+	for i := logKeep; i >= 0; i-- {
+		name := *eventsFile
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", name, i)
+		}
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event shared.Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				continue
+			}
+			if app != "" && event.App != app {
+				continue
+			}
+			if kind != "" && event.Type != kind {
+				continue
+			}
+			if !since.IsZero() && event.Time.Before(since) {
+				continue
+			}
+			res = append(res, event)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if limit > 0 && len(res) > limit {
+		res = res[len(res)-limit:]
+	}
+	return res, nil
+}
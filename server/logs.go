@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"lambdaroach/shared"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+var logDir = flag.String("logdir", "logs", "directory for the per app log files")
+var logLines = flag.Int("loglines", 1000, "number of log lines per app kept in memory")
+var logSize = flag.Int64("logsize", 10*1024*1024, "size at which log files are rotated")
+
+// number of rotated log files kept, like app.log.1 ... app.log.5
+const logKeep = 5
+
+// rotatingFile is an append only log file, rotated when it grows larger than -logsize, callers must serialize writes
+type rotatingFile struct {
+	name string
+	file *os.File
+	size int64
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.file != nil && f.size >= *logSize {
+		f.file.Close()
+		f.file = nil
+		for i := logKeep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+		}
+		if err := os.Rename(f.name, f.name+".1"); err != nil {
+			return 0, err
+		}
+	}
+	if f.file == nil {
+		if err := os.MkdirAll(path.Dir(f.name), 0755); err != nil {
+			return 0, err
+		}
+		file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return 0, err
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+		f.file = file
+		f.size = stat.Size()
+	}
+
+	written, err := f.file.Write(p)
+	f.size += int64(written)
+	return written, err
+}
+
+// appLog captures the output of all instances of an app, in a ring buffer and in log files
+type appLog struct {
+	lock  sync.Mutex
+	lines []shared.LogLine
+	next  int // next position in lines, once lines is full
+	file  rotatingFile
+	tails map[chan shared.LogLine]bool
+	gone  bool // app was deleted, instances still exiting don't write anymore
+}
+
+var appLogsLock = sync.Mutex{}
+var appLogs = map[string]*appLog{}
+
+func getAppLog(app string) *appLog {
+	appLogsLock.Lock()
+	defer appLogsLock.Unlock()
+	return getAppLogLocked(app)
+}
+
+// getAppLogLocked must be called holding appLogsLock
+func getAppLogLocked(app string) *appLog {
+	l := appLogs[app]
+	if l == nil {
+		l = &appLog{file: rotatingFile{name: path.Join(*logDir, logFileName(app))}}
+		appLogs[app] = l
+	}
+	return l
+}
+
+// app names come from clients, never let them escape the log dir
+func logFileName(app string) string {
+	name := []byte(app)
+	for i, c := range name {
+		if !(c == '-' || c == '_' || (c == '.' && i > 0) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			name[i] = '_'
+		}
+	}
+	return string(name) + ".log"
+}
+
+// removeAppLog forgets the lines of a deleted app and removes its log files, so a new app with the same name starts
+// with an empty log
+func removeAppLog(app string) {
+	appLogsLock.Lock()
+	l := getAppLogLocked(app)
+	delete(appLogs, app)
+	appLogsLock.Unlock()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.gone = true
+	l.lines = nil
+	if l.file.file != nil {
+		l.file.file.Close()
+		l.file.file = nil
+	}
+	names := []string{l.file.name}
+	for i := 1; i <= logKeep; i++ {
+		names = append(names, fmt.Sprintf("%s.%d", l.file.name, i))
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Print("error removing app log: ", err)
+		}
+	}
+}
+
+func (l *appLog) add(line shared.LogLine) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.gone {
+		return
+	}
+
+	if len(l.lines) < *logLines {
+		l.lines = append(l.lines, line)
+	} else if len(l.lines) > 0 {
+		l.lines[l.next] = line
+		l.next = (l.next + 1) % len(l.lines)
+	}
+
+	if err := l.write(line); err != nil {
+		log.Print("error writing app log: ", l.file.name, " ", err)
+	}
+	l.publish(line)
+}
+
+// publish sends the line to all tails, tails that cannot keep up miss lines, must hold l.lock
+func (l *appLog) publish(line shared.LogLine) {
+	for tail := range l.tails {
+		select {
+		case tail <- line:
+		default:
+		}
+	}
+}
+
+// access sends an access log line to the tails, access lines are not kept
+func (l *appLog) access(line shared.LogLine) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.publish(line)
+}
+
+// tail queries the ring buffer and returns a channel receiving all new lines, atomically
+func (l *appLog) tail(since, until time.Time, stream string, limit int) ([]shared.LogLine, chan shared.LogLine) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.tails == nil {
+		l.tails = map[chan shared.LogLine]bool{}
+	}
+	tail := make(chan shared.LogLine, 100)
+	l.tails[tail] = true
+	return l.queryLocked(since, until, stream, limit), tail
+}
+
+func (l *appLog) untail(tail chan shared.LogLine) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.tails, tail)
+}
+
+// write appends the line as json to the log file, must hold l.lock
+func (l *appLog) write(line shared.LogLine) error {
+	bytes, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(bytes, '\n'))
+	return err
+}
+
+// query returns the lines in the ring buffer matching the time range and stream, oldest first
+func (l *appLog) query(since, until time.Time, stream string, limit int) []shared.LogLine {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.queryLocked(since, until, stream, limit)
+}
+
+func (l *appLog) queryLocked(since, until time.Time, stream string, limit int) []shared.LogLine {
+	res := []shared.LogLine{}
+	for i := range l.lines {
+		line := l.lines[(l.next+i)%len(l.lines)]
+		if stream != "" && line.Stream != stream {
+			continue
+		}
+		if !since.IsZero() && line.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && line.Time.After(until) {
+			continue
+		}
+		res = append(res, line)
+	}
+	if limit > 0 && len(res) > limit {
+		res = res[len(res)-limit:]
+	}
+	return res
+}
+
+// readlog captures the stdout or stderr of a running app instance, line by line
+func readlog(site Site, run *RunningSite, stream string, r io.Reader) {
+	logs := getAppLog(site.id)
+	in := bufio.NewReader(r)
+	for {
+		line, err := in.ReadString('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] == '\n' {
+				line = line[:len(line)-1]
+			}
+			logs.add(shared.LogLine{Time: time.Now(), App: site.id, Version: site.version, Instance: run.id, Stream: stream, Line: line})
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
+}
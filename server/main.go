@@ -5,8 +5,8 @@ import (
 	"bytes"
 	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"lambdaroach/shared"
 	"log"
@@ -24,6 +24,9 @@ import (
 	"rsc.io/letsencrypt"
 )
 
+// command line flags
+var passenv = flag.String("passenv", "", "comma separated list of server environment variables passed on to apps")
+
 // RunningSite is an up and running application server
 type RunningSite struct {
 	id      int32
@@ -33,6 +36,9 @@ type RunningSite struct {
 	start   time.Time
 	error   bool
 	working int64
+	done    chan bool // closed when the process exited
+	state   *os.ProcessState
+	stopped int32 // set before stop kills the process, otherwise an exit is a crash
 }
 
 // PidFile returns the pidfile
@@ -42,17 +48,21 @@ func (run *RunningSite) PidFile() string {
 
 // Site is the static description of an application server
 type Site struct {
-	id        string
-	version   int
-	hostnames []string
-	paths     []string
-	env       []string // {"NODE_PRODUCTION=true", ... }
-	command   string
-	data      string // path where the data resides
-	running   *RunningSite
-	certid    []byte
-	static    *http.Handler
-	httpsOnly bool // redirect to https
+	id            string
+	version       int
+	hostnames     []string
+	paths         []string // path prefixes, the longest matching prefix of all apps on a host wins
+	stripPath     bool     // remove the matched prefix before forwarding
+	rules         *shared.Rules
+	env           []string // {"NODE_PRODUCTION=true", ... }
+	command       string
+	data          string // path where the data resides
+	running       *RunningSite
+	certid        []byte
+	static        *http.Handler
+	staticOptions *shared.Static
+	compress      *shared.Compress // compress responses if set
+	httpsOnly     bool             // redirect to https
 }
 
 var lock = sync.RWMutex{}
@@ -69,39 +79,65 @@ func (a byVersion) Len() int           { return len(a) }
 func (a byVersion) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byVersion) Less(i, j int) bool { return a[i].version > a[j].version }
 
-func addSite(site *Site) {
-	log.Print("adding site:", site.hostnames)
-
+// addSite adds site as the latest version of its app, and returns the version it replaces, if any. The version is
+// assigned here, holding the lock, so concurrent deploys of an app get different versions, and hosts are checked for
+// conflicts with other apps again, they may have been deployed since the upload was checked.
+func addSite(site *Site) (*Site, error) {
 	lock.Lock()
 	defer lock.Unlock()
 
-	added := false
+	if err := hostConflictLocked(site.id, site.hostnames, site.paths); err != nil {
+		return nil, err
+	}
+	var previous *Site
 	for i, s := range latestSites {
 		if s.id == site.id {
-			if s.version == site.version {
-				panic("registering known site")
-			}
+			previous = s
 			latestSites[i] = site
-			added = true
 			break
 		}
 	}
-	if !added {
+	site.version = 1
+	if previous != nil {
+		site.version = previous.version + 1
+	} else {
 		latestSites = append(latestSites, site)
 	}
+	log.Print("adding site: ", site.id, " ", site.version, " ", site.hostnames)
 
 	sites = append(sites, site)
+	served := map[string]bool{}
 	for _, host := range site.hostnames {
+		served[host] = true
 		routes[host] = append(routes[host], site)
 		sort.Sort(byVersion(routes[host]))
 	}
 
+	// older versions are not routed for the hosts the new version dropped anymore, those are free for other apps
+	for host, hostSites := range routes {
+		if served[host] || host == "localhost" {
+			continue
+		}
+		keep := []*Site{}
+		for _, s := range hostSites {
+			if s.id != site.id {
+				keep = append(keep, s)
+			}
+		}
+		if len(keep) == 0 {
+			delete(routes, host)
+		} else {
+			routes[host] = keep
+		}
+	}
+
 	if len(latestSites) == 1 {
 		routes["localhost"] = append(routes["localhost"], site)
 		sort.Sort(byVersion(routes["localhost"]))
 	} else {
 		routes["localhost"] = []*Site{}
 	}
+	return previous, nil
 }
 
 func findSite(id string) *Site {
@@ -118,33 +154,221 @@ func findSite(id string) *Site {
 	return res
 }
 
-func matchSite(host, path string) (*Site, *RunningSite) {
+// findVersion returns a specific version of app id
+func findVersion(id string, version int) *Site {
 	lock.RLock()
 	defer lock.RUnlock()
-	sites := routes[host]
-	for _, site := range sites {
-		for _, prefix := range site.paths {
-			if shared.StartsWith(path, prefix) {
-				return site, site.running
+	for _, s := range sites {
+		if s.id == id && s.version == version {
+			return s
+		}
+	}
+	return nil
+}
+
+// removeApp removes all versions of app id from the server, and returns them, the caller has to stop them
+func removeApp(id string) []*Site {
+	log.Print("removing app: ", id)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	removed := []*Site{}
+	keep := []*Site{}
+	for _, s := range sites {
+		if s.id == id {
+			removed = append(removed, s)
+		} else {
+			keep = append(keep, s)
+		}
+	}
+	sites = keep
+
+	latest := []*Site{}
+	for _, s := range latestSites {
+		if s.id != id {
+			latest = append(latest, s)
+		}
+	}
+	latestSites = latest
+
+	for host, hostSites := range routes {
+		keep := []*Site{}
+		for _, s := range hostSites {
+			if s.id != id {
+				keep = append(keep, s)
+			}
+		}
+		if len(keep) == 0 {
+			delete(routes, host)
+		} else {
+			routes[host] = keep
+		}
+	}
+
+	// like addSite, if only one app is left, it is also served as localhost
+	routes["localhost"] = []*Site{}
+	if len(latestSites) == 1 {
+		for _, s := range sites {
+			if s.id == latestSites[0].id {
+				routes["localhost"] = append(routes["localhost"], s)
 			}
 		}
+		sort.Sort(byVersion(routes["localhost"]))
 	}
-	return nil, nil
+	return removed
 }
 
-func readlog(r io.Reader) {
-	in := bufio.NewReader(r)
-	for {
-		line, err := in.ReadString('\n')
-		if err == io.EOF {
-			return
+// usesCertificate checks if any site still uses certificate certid
+func usesCertificate(certid []byte) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, s := range sites {
+		if bytes.Equal(s.certid, certid) {
+			return true
 		}
-		if err != nil {
-			log.Print(err)
-			return
+	}
+	return false
+}
+
+// hostConflict returns an error if another app already serves one of paths on one of hosts
+func hostConflict(id string, hosts, paths []string) error {
+	lock.RLock()
+	defer lock.RUnlock()
+	return hostConflictLocked(id, hosts, paths)
+}
+
+// hostConflictLocked must be called holding lock, only the latest version of each other app routed for a host counts,
+// an older version is checked again when it is rolled back to
+func hostConflictLocked(id string, hosts, paths []string) error {
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	for _, h := range hosts {
+		if h == "" {
+			continue
+		}
+		for _, s := range latestRoutes(h) {
+			if s.id == id || !servesHost(s, h) {
+				continue
+			}
+			for _, prefix := range s.paths {
+				for _, p := range paths {
+					if p == prefix {
+						return fmt.Errorf("hostname %s path %s is already used by app: %s", h, p, s.id)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// servesHost checks if host is one of the hostnames of site, routes also has sites for localhost they don't list
+func servesHost(site *Site, host string) bool {
+	for _, h := range site.hostnames {
+		if h == host {
+			return true
 		}
-		log.Print(line)
 	}
+	return false
+}
+
+// routeNames returns the names in routes that can serve host, most specific first, host itself and then the
+// wildcards of its parent domains, like *.b.example.com and *.example.com for a.b.example.com
+func routeNames(host string) []string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	names := []string{host}
+	labels := strings.Split(host, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		names = append(names, "*."+strings.Join(labels[i:], "."))
+	}
+	return names
+}
+
+// latestRoutes returns the latest version of each app in routes for name, must be called holding lock
+func latestRoutes(name string) []*Site {
+	latest := []*Site{}
+	seen := map[string]bool{}
+	// routes are sorted by version
+	for _, site := range routes[name] {
+		if !seen[site.id] {
+			seen[site.id] = true
+			latest = append(latest, site)
+		}
+	}
+	return latest
+}
+
+// matchPath checks if path is prefix or inside of it, so /api matches /api and /api/users, but not /apis
+func matchPath(path, prefix string) bool {
+	return prefix == "/" || path == prefix || shared.StartsWith(path, prefix+"/")
+}
+
+// matchSite returns the site serving path on host, and the path prefix it matched. Sites of host itself win over
+// wildcard hosts, and of those the latest version of the app with the longest matching prefix wins.
+func matchSite(host, path string) (*Site, *RunningSite, string) {
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, name := range routeNames(host) {
+		var match *Site
+		var matched string
+		for _, site := range latestRoutes(name) {
+			for _, prefix := range site.paths {
+				if matchPath(path, prefix) && (match == nil || len(prefix) > len(matched)) {
+					match, matched = site, prefix
+				}
+			}
+		}
+		if match != nil {
+			return match, match.running, matched
+		}
+	}
+	return nil, nil, ""
+}
+
+// stripPrefix removes the matched prefix from the path of a request, and tells the app in X-Forwarded-Prefix
+func stripPrefix(r *http.Request, prefix string) {
+	if prefix == "/" {
+		return
+	}
+	r.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.RawPath, prefix), "/")
+	}
+	r.Header.Set("X-Forwarded-Prefix", prefix)
+}
+
+// getenv returns the server environment variable, or def if not set
+func getenv(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
+
+// appEnv builds the environment of an app, apps never see the full server environment, only a curated
+// base, the variables explicitly passed through using -passenv, and their own env
+func appEnv(site Site, run *RunningSite, ports string) []string {
+	env := []string{
+		"PATH=" + getenv("PATH", "/usr/local/bin:/usr/bin:/bin"),
+		"HOME=" + site.data,
+		"LANG=" + getenv("LANG", "C.UTF-8"),
+		"PORT=" + ports,
+		shared.ReservedEnvPrefix + "APP=" + site.id,
+		shared.ReservedEnvPrefix + fmt.Sprintf("VERSION=%d", site.version),
+		shared.ReservedEnvPrefix + fmt.Sprintf("INSTANCE=%d", run.id),
+	}
+	for _, name := range strings.Split(*passenv, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || shared.IsReservedEnv(name) {
+			continue
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return append(env, site.env...)
 }
 
 func launch(site Site) (*RunningSite, error) {
@@ -152,11 +376,11 @@ func launch(site Site) (*RunningSite, error) {
 	id := rand.Int31()
 	port++
 	ports := fmt.Sprintf("%d", port)
-	run := &RunningSite{id: id, addr: fmt.Sprintf("localhost:%s", ports), pidfile: fmt.Sprintf("%d.pid", id), start: time.Now()}
+	run := &RunningSite{id: id, addr: fmt.Sprintf("localhost:%s", ports), pidfile: fmt.Sprintf("%d.pid", id), start: time.Now(), done: make(chan bool)}
 
 	// figure out path of executable
 	split := strings.Split(strings.Replace(site.command, "${PORT}", ports, -1), " ")
-	path, err := exec.LookPath(split[0])
+	path, err := commandPath(site.data, split[0])
 	if err != nil {
 		return run, err
 	}
@@ -164,10 +388,11 @@ func launch(site Site) (*RunningSite, error) {
 	// build command
 	run.cmd = exec.Command(path, split[1:]...)
 	run.cmd.Dir = site.data
-	env := os.Environ()
-	env = append(env, site.env...)
-	env = append(env, fmt.Sprintf("PORT=%s", ports))
-	run.cmd.Env = env
+	secrets, err := appSecrets(site.id)
+	if err != nil {
+		return run, err
+	}
+	run.cmd.Env = append(appEnv(site, run, ports), secrets...)
 
 	// hook up stderr/stdout to logger
 	stdout, err := run.cmd.StdoutPipe()
@@ -188,9 +413,17 @@ func launch(site Site) (*RunningSite, error) {
 		return run, err
 	}
 
-	// run loggers
-	go readlog(stdout)
-	go readlog(stderr)
+	// run loggers and wait for the process to exit
+	go readlog(site, run, "stdout", stdout)
+	go readlog(site, run, "stderr", stderr)
+	go func() {
+		state, err := run.cmd.Process.Wait()
+		if err != nil {
+			log.Print("wait error: ", site.id, " ", run.id, " ", err)
+		}
+		run.state = state
+		close(run.done)
+	}()
 	log.Print("launched app: ", site.id, " ", run.id, " pid: ", run.cmd.Process.Pid, " port: ", ports)
 
 	// set time again incase launching takes a while
@@ -198,9 +431,11 @@ func launch(site Site) (*RunningSite, error) {
 	return run, nil
 }
 
-func stop(site *Site, running *RunningSite, err error) {
+// stop lets a running app bleed out, the reason is used for metrics, like "error" or "update"
+func stop(site *Site, running *RunningSite, reason string, err error) {
 	if err != nil {
 		log.Print("stopping site due to error: ", err)
+		recordError(site.id, err.Error())
 	}
 
 	// bleed out by clearing the site.running field (under lock)
@@ -214,10 +449,11 @@ func stop(site *Site, running *RunningSite, err error) {
 		running = nil
 	}()
 
-	// only the process that clears the running field needs to close it up
-	if running == nil {
+	// only the process that clears the running field needs to close it up, and only if it was launched
+	if running == nil || running.error {
 		return
 	}
+	stopsTotal.inc(site.id, fmt.Sprintf("%d", site.version), reason)
 	// this would be weird
 	if site.running == running {
 		log.Fatal("still site.running == running")
@@ -225,13 +461,8 @@ func stop(site *Site, running *RunningSite, err error) {
 
 	// wait until running.working drops to zero, then stop the app, or forces stop after X time
 	go func() {
-		tries := 0
-		for {
-			tries++
+		for tries := 0; ; tries++ {
 			stillrunning := atomic.LoadInt64(&running.working)
-			if stillrunning > 0 {
-				continue
-			}
 			if stillrunning < 0 {
 				log.Fatal("running.working < 1")
 			}
@@ -245,57 +476,165 @@ func stop(site *Site, running *RunningSite, err error) {
 			time.Sleep(100 * time.Millisecond)
 		}
 
+		atomic.StoreInt32(&running.stopped, 1)
 		running.cmd.Process.Kill()
-		status, err := running.cmd.Process.Wait()
-		if err != nil {
-			log.Fatal(err)
+		<-running.done
+		log.Print("stopped app: ", site.id, " ", running.id, " pid: ", running.cmd.Process.Pid, " status: ", running.state)
+		siteEvent(shared.EventStopped, site, running, reason)
+	}()
+}
+
+// watch waits for a running app to exit, if it was not stopped it crashed, and is stopped so a next request relaunches it
+func watch(site *Site, running *RunningSite) {
+	<-running.done
+	if atomic.LoadInt32(&running.stopped) != 0 {
+		return
+	}
+	log.Print("app crashed: ", site.id, " ", running.id, " status: ", running.state)
+	recordError(site.id, fmt.Sprintf("crashed: %v", running.state))
+	siteEvent(shared.EventCrashed, site, running, fmt.Sprintf("%v", running.state))
+	stop(site, running, "crash", nil)
+}
+
+// retireSite lets the running instance of site bleed out, if any
+func retireSite(site *Site, reason string) {
+	lock.RLock()
+	running := site.running
+	lock.RUnlock()
+	if running != nil {
+		stop(site, running, reason, nil)
+	}
+}
+
+// restartApp stops all running instances of app id, new requests will launch them again
+func restartApp(id string) {
+	type instance struct {
+		site    *Site
+		running *RunningSite
+	}
+	var instances []instance
+	func() {
+		lock.RLock()
+		defer lock.RUnlock()
+		for _, s := range sites {
+			if s.id == id && s.running != nil {
+				instances = append(instances, instance{s, s.running})
+			}
 		}
-		log.Print("stopped app: ", site.id, " ", running.id, " pid: ", running.cmd.Process.Pid, " status: ", status)
 	}()
+
+	for _, i := range instances {
+		log.Print("restarting app: ", i.site.id, " ", i.site.version, " ", i.running.id)
+		stop(i.site, i.running, "restart", nil)
+	}
 }
 
 // blindly write status
-func write404(w http.ResponseWriter, r *http.Request, start time.Time) {
+func write404(w *accessWriter) {
 	w.WriteHeader(404)
 	w.Write([]byte("404 Not Found"))
-	log.Printf("%s %s 404 %0.3f", r.Method, r.RequestURI, time.Since(start).Seconds())
 }
 
-func write500(w http.ResponseWriter, r *http.Request, start time.Time, msg string) {
+func write500(w *accessWriter, msg string) {
+	w.msg = msg
 	w.WriteHeader(500)
 	w.Write([]byte("500 Internal Error"))
-	log.Printf("%s %s 500 %0.3f (%s)", r.Method, r.RequestURI, time.Since(start).Seconds(), msg)
 }
 
-func serveStatic(site *Site, w http.ResponseWriter, r *http.Request) {
-	if site.static == nil {
-		func() {
-			lock.Lock()
-			defer lock.Unlock()
-			static := http.FileServer(http.Dir(site.data))
-			site.static = &static
-		}()
+// redirectRequest applies the canonical host and redirect rules of a site to a request, and returns true if it wrote
+// a redirect, the response header rules are applied to all responses
+func redirectRequest(site *Site, w *accessWriter, r *http.Request) bool {
+	rules := site.rules
+	if rules == nil {
+		return false
+	}
+	w.headers = rules.ResponseHeaders
+
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, ""
+	}
+	if rules.CanonicalHost != "" && !strings.EqualFold(host, rules.CanonicalHost) {
+		// like httpsOnly, switching to https drops the port
+		u := *r.URL
+		u.Scheme = "http"
+		if r.TLS != nil || site.httpsOnly {
+			u.Scheme = "https"
+		}
+		u.Host = rules.CanonicalHost
+		if port != "" && (r.TLS != nil || !site.httpsOnly) {
+			u.Host = net.JoinHostPort(rules.CanonicalHost, port)
+		}
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return true
+	}
+
+	for _, redirect := range rules.Redirects {
+		to, ok := shared.MatchRule(redirect.From, redirect.To, r.URL.EscapedPath())
+		if !ok {
+			continue
+		}
+		if r.URL.RawQuery != "" && !strings.Contains(to, "?") {
+			to += "?" + r.URL.RawQuery
+		}
+		status := redirect.Status
+		if status == 0 {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, to, status)
+		return true
 	}
-	static := *site.static
-	static.ServeHTTP(w, r)
+	return false
+}
+
+// rewriteRequest applies the rewrites and request header rules of a site to a request
+func rewriteRequest(site *Site, r *http.Request) {
+	rules := site.rules
+	if rules == nil {
+		return
+	}
+	for _, rewrite := range rules.Rewrites {
+		if to, ok := shared.MatchRule(rewrite.From, rewrite.To, r.URL.Path); ok {
+			r.URL.Path = to
+			r.URL.RawPath = ""
+			break
+		}
+	}
+	rules.RequestHeaders.Apply(r.Header)
 }
 
 // this receives the http requests, checks what to do, and replies
-func serve(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
+func serve(rw http.ResponseWriter, r *http.Request) {
+	w := &accessWriter{ResponseWriter: rw, start: time.Now()}
+	defer logAccess(w, r)
 
 	host := strings.Split(r.Host, ":")[0]
-	path := r.RequestURI
-	site, running := matchSite(host, path)
+	site, running, prefix := matchSite(host, r.URL.Path)
 
 	if site == nil {
-		write404(w, r, start)
+		write404(w)
+		return
+	}
+	w.site = site
+	if site.compress != nil {
+		cw := newCompressWriter(w.ResponseWriter, r, *site.compress)
+		w.ResponseWriter = cw
+		defer func() {
+			// log the bytes sent, not the bytes before compressing
+			bytes, err := cw.Close()
+			if err != nil && w.msg == "" {
+				w.msg = "compressing"
+			}
+			w.bytes = bytes
+		}()
+	}
+	if redirectRequest(site, w, r) {
 		return
 	}
 
 	if site.httpsOnly && r.TLS == nil {
 		if r.Host == "" {
-			write404(w, r, start)
+			write404(w)
 			return
 		}
 
@@ -305,10 +644,15 @@ func serve(w http.ResponseWriter, r *http.Request) {
 		u.Host = host
 		u.Scheme = "https"
 		http.Redirect(w, r, u.String(), 302)
-		log.Print("redirected to: ", u.String())
 		return
 	}
 
+	r.Header.Del("X-Forwarded-Prefix")
+	rewriteRequest(site, r)
+	if site.stripPath {
+		stripPrefix(r, prefix)
+	}
+
 	if site.command == "" {
 		serveStatic(site, w, r)
 		return
@@ -337,10 +681,19 @@ func serve(w http.ResponseWriter, r *http.Request) {
 			}
 
 			var err error
+			launched := time.Now()
 			running, err = launch(*site)
 			if err != nil {
 				log.Print("launch error: ", site.id, " ", running.id, " err: ", err)
+				recordError(site.id, "launch error: "+err.Error())
 				running.error = true
+				launchErrors.inc(site.id, fmt.Sprintf("%d", site.version))
+				siteEvent(shared.EventLaunchFailed, site, running, err.Error())
+			} else {
+				launchesTotal.inc(site.id, fmt.Sprintf("%d", site.version))
+				launchDuration.observe(time.Since(launched).Seconds(), site.id)
+				siteEvent(shared.EventLaunched, site, running, fmt.Sprintf("pid: %d", running.cmd.Process.Pid))
+				go watch(site, running)
 			}
 
 			// only here also take lock, so launching does not hold back old requests
@@ -350,8 +703,9 @@ func serve(w http.ResponseWriter, r *http.Request) {
 		}()
 	}
 
+	w.running = running
 	if running.error {
-		write500(w, r, start, "app in error")
+		write500(w, "app in error")
 		return
 	}
 
@@ -382,8 +736,9 @@ func serve(w http.ResponseWriter, r *http.Request) {
 		// TODO if err, relaunch and retry this part
 	}
 	if err != nil {
-		write500(w, r, start, "connecting to app")
-		stop(site, running, err)
+		write500(w, "connecting to app")
+		siteEvent(shared.EventHealthFailed, site, running, err.Error())
+		stop(site, running, "connect", err)
 		return
 	}
 
@@ -402,18 +757,20 @@ func serve(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// and write the request that came in to the downstream connection
+	upstream := time.Now()
 	err = r.Write(conn)
 	if err != nil {
-		write500(w, r, start, "writing to app")
-		stop(site, running, err)
+		write500(w, "writing to app")
+		stop(site, running, "write", err)
 		return
 	}
 
 	// read reply and send it back
 	res, err := http.ReadResponse(bufio.NewReader(conn), r)
+	w.upstream = time.Since(upstream)
 	if err != nil {
-		write500(w, r, start, "reading from app")
-		stop(site, running, err)
+		write500(w, "reading from app")
+		stop(site, running, "read", err)
 		return
 	}
 
@@ -421,7 +778,7 @@ func serve(w http.ResponseWriter, r *http.Request) {
 	// the current will bleed out, a new one will be immediately started on a next request
 	// we will however pass on the reply
 	if res.StatusCode >= 500 {
-		stop(site, running, nil)
+		stop(site, running, "status", nil)
 	}
 
 	header := w.Header()
@@ -436,13 +793,14 @@ func serve(w http.ResponseWriter, r *http.Request) {
 	defer res.Body.Close()
 	_, werr, rerr := shared.Copy(w, res.Body)
 	if werr != nil {
-		log.Print("client write error: ", err)
+		w.msg = "writing to client"
+		log.Print("client write error: ", werr)
 	}
 	if rerr != nil {
-		stop(site, running, nil)
+		w.msg = "reading body from app"
+		stop(site, running, "read", rerr)
 		return
 	}
-	log.Printf("%s %s %d %0.3f", r.Method, r.RequestURI, res.StatusCode, time.Since(start).Seconds())
 }
 
 var tlsLock = sync.RWMutex{}
@@ -474,6 +832,7 @@ func addCertificate(cert tls.Certificate, hash []byte) {
 	tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
 	tlsConfig.BuildNameToCertificate()
 	certHashes = append(certHashes, hash)
+	journal(shared.Event{Type: shared.EventCertAdded, Msg: fmt.Sprintf("%x", hash)})
 }
 
 func removeCertificate(hash []byte) {
@@ -486,12 +845,23 @@ func removeCertificate(hash []byte) {
 			certHashes = append(certHashes[:at], certHashes[at+1:]...)
 			tlsConfig.Certificates = append(tlsConfig.Certificates[:at], tlsConfig.Certificates[at+1:]...)
 			tlsConfig.BuildNameToCertificate()
+			journal(shared.Event{Type: shared.EventCertRemoved, Msg: fmt.Sprintf("%x", hash)})
 			return
 		}
 	}
 }
 
 func getCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := findCertificate(clientHello)
+	if err != nil {
+		tlsHandshakes.inc("error")
+	} else {
+		tlsHandshakes.inc("ok")
+	}
+	return cert, err
+}
+
+func findCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	// with this call here, letsencrypt will do the SNI "handshake" if relevant
 	cert, err := letsEncrypt.GetCertificate(clientHello)
 	if cert != nil || err != nil {
@@ -567,6 +937,10 @@ func maintls() {
 func main() {
 	log.SetFlags(log.Flags() | log.Lmicroseconds | log.Lshortfile)
 	log.SetPrefix("lambdaroach ")
+	flag.Parse()
+	if err := checkAccessLogFormat(); err != nil {
+		log.Fatal(err)
+	}
 
 	// TODO this should be per email, per hosts, not global
 	// TODO now tls generation is done on server, and saved there, perhaps better use client over admin?
@@ -574,6 +948,13 @@ func main() {
 		log.Fatal(err)
 	}
 	letsEncrypt.SetHosts([]string{})
+	if err := loadSecrets(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkBlobDir(); err != nil {
+		log.Fatal(err)
+	}
+	go gcBlobs()
 
 	listener, err := net.Listen("tcp", ":80")
 	if err != nil {
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is a prometheus counter or histogram, with values per combination of labels
+type metric struct {
+	name    string
+	help    string
+	kind    string // "counter" or "histogram"
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*metricValue
+}
+
+type metricValue struct {
+	count   float64
+	sum     float64
+	buckets []float64
+}
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var requestsTotal = &metric{name: "lambdaroach_requests_total", help: "HTTP requests by site, version and status class.",
+	kind: "counter", labels: []string{"site", "version", "status"}}
+var requestDuration = &metric{name: "lambdaroach_request_duration_seconds", help: "Total latency of HTTP requests.",
+	kind: "histogram", labels: []string{"site", "version"}, buckets: latencyBuckets}
+var upstreamDuration = &metric{name: "lambdaroach_upstream_duration_seconds", help: "Latency of apps until response headers.",
+	kind: "histogram", labels: []string{"site", "version"}, buckets: latencyBuckets}
+var launchesTotal = &metric{name: "lambdaroach_launches_total", help: "App instances launched.",
+	kind: "counter", labels: []string{"site", "version"}}
+var launchDuration = &metric{name: "lambdaroach_launch_duration_seconds", help: "Time it takes to launch an app instance.",
+	kind: "histogram", labels: []string{"site"}, buckets: latencyBuckets}
+var launchErrors = &metric{name: "lambdaroach_launch_errors_total", help: "App instances that failed to launch.",
+	kind: "counter", labels: []string{"site", "version"}}
+var stopsTotal = &metric{name: "lambdaroach_stops_total", help: "App instances stopped, by reason.",
+	kind: "counter", labels: []string{"site", "version", "reason"}}
+var tlsHandshakes = &metric{name: "lambdaroach_tls_handshakes_total", help: "TLS handshakes, by result.",
+	kind: "counter", labels: []string{"result"}}
+
+var allMetrics = []*metric{requestsTotal, requestDuration, upstreamDuration, launchesTotal, launchDuration, launchErrors, stopsTotal, tlsHandshakes}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func (m *metric) key(values []string) string {
+	pairs := make([]string, len(m.labels))
+	for i, label := range m.labels {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label, escapeLabel(values[i]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metric) get(values []string) *metricValue {
+	if len(values) != len(m.labels) {
+		panic("bad number of labels for metric: " + m.name)
+	}
+	if m.values == nil {
+		m.values = map[string]*metricValue{}
+	}
+	key := m.key(values)
+	v := m.values[key]
+	if v == nil {
+		v = &metricValue{buckets: make([]float64, len(m.buckets))}
+		m.values[key] = v
+	}
+	return v
+}
+
+func (m *metric) inc(values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.get(values).count++
+}
+
+func (m *metric) observe(x float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v := m.get(values)
+	v.count++
+	v.sum += x
+	for i, le := range m.buckets {
+		if x <= le {
+			v.buckets[i]++
+		}
+	}
+}
+
+func labelsWith(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+// write writes the metric in the prometheus text format
+func (m *metric) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := []string{}
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := m.values[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s{%s} %g\n", m.name, key, v.count)
+			continue
+		}
+		for i, le := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s} %g\n", m.name, labelsWith(key, fmt.Sprintf(`le="%g"`, le)), v.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s} %g\n", m.name, labelsWith(key, `le="+Inf"`), v.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", m.name, key, v.sum)
+		fmt.Fprintf(w, "%s_count{%s} %g\n", m.name, key, v.count)
+	}
+}
+
+// observeRequest updates the request metrics from an access log entry
+func observeRequest(entry accessEntry) {
+	version := ""
+	if entry.Site != "" {
+		version = fmt.Sprintf("%d", entry.Version)
+	}
+	requestsTotal.inc(entry.Site, version, fmt.Sprintf("%dxx", entry.Status/100))
+	requestDuration.observe(entry.Total, entry.Site, version)
+	if entry.Upstream > 0 {
+		upstreamDuration.observe(entry.Upstream, entry.Site, version)
+	}
+}
+
+// writeInFlight writes the requests currently handled by each running app instance
+func writeInFlight(w io.Writer) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	name := "lambdaroach_requests_in_flight"
+	fmt.Fprintf(w, "# HELP %s Requests currently handled by app instances.\n# TYPE %s gauge\n", name, name)
+	for _, site := range sites {
+		if site.running == nil || site.running.error {
+			continue
+		}
+		working := atomic.LoadInt64(&site.running.working)
+		fmt.Fprintf(w, "%s{site=\"%s\",version=\"%d\",instance=\"%d\"} %d\n", name, escapeLabel(site.id), site.version, site.running.id, working)
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+	writeInFlight(w)
+}
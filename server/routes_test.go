@@ -0,0 +1,275 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+// resetSites starts a test without any sites
+func resetSites(t *testing.T) {
+	lock.Lock()
+	sites, latestSites, routes = nil, nil, make(map[string][]*Site)
+	lock.Unlock()
+	t.Cleanup(func() {
+		lock.Lock()
+		sites, latestSites, routes = nil, nil, make(map[string][]*Site)
+		lock.Unlock()
+	})
+}
+
+// deploy adds a version of app id serving paths on hosts, as a static site of an empty directory
+func deploy(t *testing.T, id string, hosts []string, paths ...string) *Site {
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	site := &Site{id: id, hostnames: hosts, paths: paths, data: t.TempDir()}
+	if _, err := addSite(site); err != nil {
+		t.Fatal("oeps", id, err)
+	}
+	return site
+}
+
+func TestRouteNames(t *testing.T) {
+	tests := []struct {
+		host  string
+		names []string
+	}{
+		{"example.com", []string{"example.com"}},
+		{"localhost", []string{"localhost"}},
+		{"www.example.com", []string{"www.example.com", "*.example.com"}},
+		{"A.B.Example.COM.", []string{"a.b.example.com", "*.b.example.com", "*.example.com"}},
+	}
+	for _, test := range tests {
+		names := routeNames(test.host)
+		if len(names) != len(test.names) {
+			t.Fatal("oeps", test.host, names)
+		}
+		for i := range names {
+			if names[i] != test.names[i] {
+				t.Fatal("oeps", test.host, names)
+			}
+		}
+	}
+}
+
+func TestMatchSite(t *testing.T) {
+	resetSites(t)
+	web := deploy(t, "web", []string{"example.com", "www.example.com"})
+	api := deploy(t, "api", []string{"example.com"}, "/api", "/api/v2/admin")
+	admin := deploy(t, "admin", []string{"example.com"}, "/api/v2")
+	wild := deploy(t, "wild", []string{"*.example.com"})
+	sub := deploy(t, "sub", []string{"*.b.example.com"}, "/sub")
+
+	tests := []struct {
+		host, path string
+		site       *Site
+		prefix     string
+	}{
+		{"example.com", "/", web, "/"},
+		{"example.com", "/index.html", web, "/"},
+		{"EXAMPLE.com.", "/api", api, "/api"},
+		{"example.com", "/api/users", api, "/api"},
+		{"example.com", "/apis", web, "/"},
+		{"example.com", "/api/v2/users", admin, "/api/v2"},
+		{"example.com", "/api/v2/admin/x", api, "/api/v2/admin"},
+		{"www.example.com", "/api", web, "/"},
+		{"a.example.com", "/api", wild, "/"},
+		{"a.b.example.com", "/sub/x", sub, "/sub"},
+		// the most specific host with a matching path wins, not the longest prefix of all
+		{"a.b.example.com", "/other", wild, "/"},
+		{"other.com", "/", nil, ""},
+		{"com", "/", nil, ""},
+	}
+	for _, test := range tests {
+		site, _, prefix := matchSite(test.host, test.path)
+		if site != test.site || prefix != test.prefix {
+			t.Fatal("oeps", test.host, test.path, site, prefix)
+		}
+	}
+
+	// only the latest version of an app counts, also for the prefixes of older versions
+	web2 := deploy(t, "web", []string{"example.com", "www.example.com"}, "/", "/old")
+	web3 := deploy(t, "web", []string{"example.com", "www.example.com"})
+	if site, _, _ := matchSite("example.com", "/old"); site != web3 || web3.version != 3 || web2.version != 2 {
+		t.Fatal("oeps", site)
+	}
+
+	// a single app is served as localhost too
+	resetSites(t)
+	only := deploy(t, "only", []string{"example.com"})
+	if site, _, _ := matchSite("localhost", "/"); site != only {
+		t.Fatal("oeps", site)
+	}
+	deploy(t, "second", []string{"other.com"})
+	if site, _, _ := matchSite("localhost", "/"); site != nil {
+		t.Fatal("oeps", site)
+	}
+}
+
+func TestHostConflict(t *testing.T) {
+	resetSites(t)
+	deploy(t, "web", []string{"example.com", "*.example.com"})
+	deploy(t, "api", []string{"example.com"}, "/api")
+
+	tests := []struct {
+		id    string
+		hosts []string
+		paths []string
+		ok    bool
+	}{
+		{"other", []string{"example.com"}, nil, false},
+		{"other", []string{"example.com"}, []string{"/"}, false},
+		{"other", []string{"example.com"}, []string{"/api"}, false},
+		{"other", []string{"example.com"}, []string{"/api/v2"}, true},
+		{"other", []string{"example.com"}, []string{"/apis"}, true},
+		{"other", []string{"*.example.com"}, nil, false},
+		{"other", []string{"www.example.com"}, nil, true},
+		{"other", []string{"", "other.com"}, nil, true},
+		{"web", []string{"example.com"}, nil, true},
+		{"api", []string{"example.com"}, []string{"/api"}, true},
+	}
+	for i, test := range tests {
+		if err := hostConflict(test.id, test.hosts, test.paths); (err == nil) != test.ok {
+			t.Fatal("oeps", i, err)
+		}
+	}
+
+	// addSite checks again, another app may have been deployed since the upload was checked
+	if _, err := addSite(&Site{id: "other", hostnames: []string{"example.com"}, paths: []string{"/api"}}); err == nil {
+		t.Fatal("oeps")
+	}
+
+	// an app that moved from /api to / no longer conflicts on /api
+	deploy(t, "api", []string{"example.com"}, "/v1")
+	if err := hostConflict("other", []string{"example.com"}, []string{"/api"}); err != nil {
+		t.Fatal("oeps", err)
+	}
+	if err := hostConflict("other", []string{"example.com"}, []string{"/v1"}); err == nil {
+		t.Fatal("oeps")
+	}
+}
+
+func TestAddSitePrunes(t *testing.T) {
+	resetSites(t)
+	v1 := deploy(t, "web", []string{"example.com", "old.example.com"})
+	deploy(t, "other", []string{"other.com"})
+	v2 := deploy(t, "web", []string{"example.com"})
+
+	if len(routes["example.com"]) != 2 || routes["example.com"][0] != v2 || routes["example.com"][1] != v1 {
+		t.Fatal("oeps", routes["example.com"])
+	}
+	if _, ok := routes["old.example.com"]; ok {
+		t.Fatal("oeps", routes["old.example.com"])
+	}
+	if site, _, _ := matchSite("old.example.com", "/"); site != nil {
+		t.Fatal("oeps", site)
+	}
+
+	// the dropped host is free for another app
+	if err := hostConflict("other", []string{"old.example.com"}, nil); err != nil {
+		t.Fatal("oeps", err)
+	}
+	other := deploy(t, "other", []string{"other.com", "old.example.com"})
+	if site, _, _ := matchSite("old.example.com", "/"); site != other {
+		t.Fatal("oeps", site)
+	}
+
+	// removing an app removes all its routes
+	if removed := removeApp("web"); len(removed) != 2 {
+		t.Fatal("oeps", removed)
+	}
+	if _, ok := routes["example.com"]; ok {
+		t.Fatal("oeps")
+	}
+	if site, _, _ := matchSite("localhost", "/"); site != other {
+		t.Fatal("oeps", site)
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		match        bool
+	}{
+		{"/", "/", true},
+		{"/anything", "/", true},
+		{"/api", "/api", true},
+		{"/api/", "/api", true},
+		{"/api/users", "/api", true},
+		{"/apis", "/api", false},
+		{"/ap", "/api", false},
+		{"/", "/api", false},
+		{"/api/v2", "/api/v2", true},
+		{"/api/v20", "/api/v2", false},
+	}
+	for _, test := range tests {
+		if matchPath(test.path, test.prefix) != test.match {
+			t.Fatal("oeps", test.path, test.prefix)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	tests := []struct {
+		url, prefix, path, rawPath, header string
+	}{
+		{"/api/users?a=b", "/api", "/users", "", "/api"},
+		{"/api", "/api", "/", "", "/api"},
+		{"/api/", "/api", "/", "", "/api"},
+		{"/api//x", "/api", "/x", "", "/api"},
+		{"/api/a%2Fb", "/api", "/a/b", "/a%2Fb", "/api"},
+		{"/users", "/", "/users", "", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		stripPrefix(r, test.prefix)
+		if r.URL.Path != test.path || r.URL.RawPath != test.rawPath || r.Header.Get("X-Forwarded-Prefix") != test.header {
+			t.Fatal("oeps", test.url, r.URL.Path, r.URL.RawPath, r.Header)
+		}
+		if test.url == "/api/users?a=b" && r.URL.RawQuery != "a=b" {
+			t.Fatal("oeps", r.URL.RawQuery)
+		}
+	}
+}
+
+// serveRequest lets serve handle a request, with headers as name, value pairs
+func serveRequest(method, url string, headers ...string) (*http.Request, *httptest.ResponseRecorder) {
+	r := httptest.NewRequest(method, url, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	serve(w, r)
+	return r, w
+}
+
+func TestServeStripPath(t *testing.T) {
+	inTempDir(t)
+	resetSites(t)
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	docs := &Site{id: "docs", hostnames: []string{"example.com"}, paths: []string{"/docs"}, stripPath: true, data: dir}
+	if _, err := addSite(docs); err != nil {
+		t.Fatal(err)
+	}
+	deploy(t, "web", []string{"example.com"})
+
+	r, w := serveRequest("GET", "http://example.com/docs/a.txt", "X-Forwarded-Prefix", "/evil")
+	if w.Code != 200 || w.Body.String() != "hello" || r.Header.Get("X-Forwarded-Prefix") != "/docs" {
+		t.Fatal("oeps", w.Code, w.Body.String(), r.Header)
+	}
+	// without stripping, a prefix sent by the client does not reach the app either
+	docs.stripPath = false
+	r, w = serveRequest("GET", "http://example.com/docs/a.txt", "X-Forwarded-Prefix", "/evil")
+	if w.Code != 404 || r.Header.Get("X-Forwarded-Prefix") != "" {
+		t.Fatal("oeps", w.Code, r.Header)
+	}
+	if _, w := serveRequest("GET", "http://example.com/docsa.txt"); w.Code != 404 {
+		t.Fatal("oeps", w.Code)
+	}
+}
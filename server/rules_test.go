@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"lambdaroach/shared"
+)
+
+func TestServeRules(t *testing.T) {
+	inTempDir(t)
+	resetSites(t)
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dir, "index.html"), []byte("index"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	site := &Site{id: "web", hostnames: []string{"example.com", "www.example.com"}, paths: []string{"/"}, data: dir}
+	site.rules = &shared.Rules{
+		CanonicalHost: "example.com",
+		Redirects: []shared.Redirect{
+			{From: "/old/*", To: "/new/*", Status: 308},
+			{From: "/blog", To: "https://blog.example.com/"},
+			{From: "/go/*", To: "/*"},
+			{From: "/query", To: "/new?b=c"},
+		},
+		Rewrites:        []shared.Rewrite{{From: "/app/*", To: "/index.html"}},
+		RequestHeaders:  shared.HeaderRules{Set: map[string]string{"X-App": "1"}, Remove: []string{"Cookie"}},
+		ResponseHeaders: shared.HeaderRules{Set: map[string]string{"X-Frame-Options": "DENY"}},
+	}
+	if _, err := addSite(site); err != nil {
+		t.Fatal(err)
+	}
+
+	redirects := []struct {
+		url      string
+		status   int
+		location string
+	}{
+		{"http://www.example.com/x?a=b", 301, "http://example.com/x?a=b"},
+		{"http://www.example.com:8080/x", 301, "http://example.com:8080/x"},
+		{"http://example.com/old/a?q=1", 308, "/new/a?q=1"},
+		{"http://example.com/blog", 301, "https://blog.example.com/"},
+		{"http://example.com/query?a=b", 301, "/new?b=c"},
+		// the rest of the path cannot redirect to another host
+		{"http://example.com/go//evil.example", 301, "/evil.example"},
+		{"http://example.com/go/%5Cevil.example", 301, "/%5Cevil.example"},
+	}
+	for _, test := range redirects {
+		_, w := serveRequest("GET", test.url)
+		if w.Code != test.status || w.Header().Get("Location") != test.location || w.Header().Get("X-Frame-Options") != "DENY" {
+			t.Fatal("oeps", test.url, w.Code, w.Header())
+		}
+	}
+
+	// canonicalhost redirects to https, dropping the port, for https only apps
+	site.httpsOnly = true
+	if _, w := serveRequest("GET", "http://www.example.com:8080/x"); w.Code != 301 || w.Header().Get("Location") != "https://example.com/x" {
+		t.Fatal("oeps", w.Code, w.Header())
+	}
+	site.httpsOnly = false
+
+	r, w := serveRequest("GET", "http://example.com/app/users", "Cookie", "a=b", "X-App", "2")
+	if w.Code != 200 || w.Body.String() != "index" || w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatal("oeps", w.Code, w.Body.String(), w.Header())
+	}
+	if r.URL.Path != "/index.html" || r.Header.Get("X-App") != "1" || r.Header.Get("Cookie") != "" {
+		t.Fatal("oeps", r.URL.Path, r.Header)
+	}
+	if _, w := serveRequest("GET", "http://example.com/missing"); w.Code != 404 || w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatal("oeps", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+var secretKeyFile = flag.String("secretkey", "secrets.key", "file with the key used to encrypt app secrets, created if missing")
+
+const secretsFile = "secrets.json"
+
+// secrets are stored per app, per key, encrypted using AES-GCM as base64(nonce|ciphertext)
+var secretsLock = sync.Mutex{}
+var secrets = map[string]map[string]string{}
+var secretsAEAD cipher.AEAD
+
+// loadSecretKey reads the server key, or generates and saves a new one
+func loadSecretKey(name string) ([]byte, error) {
+	key, err := ioutil.ReadFile(name)
+	if err == nil {
+		if len(key) != 32 {
+			return nil, errors.New("secret key must be 32 bytes: " + name)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Print("generating new secret key: ", name)
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(name, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func loadSecrets() error {
+	key, err := loadSecretKey(*secretKeyFile)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	secretsAEAD = aead
+
+	bytes, err := ioutil.ReadFile(secretsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, &secrets)
+}
+
+// saveSecrets must be called holding secretsLock
+func saveSecrets() error {
+	bytes, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(secretsFile+".tmp", bytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(secretsFile+".tmp", secretsFile)
+}
+
+// the app and key are authenticated with the value, so encrypted values cannot be swapped around
+func secretData(app, key string) []byte {
+	return []byte(app + "\x00" + key)
+}
+
+func setSecret(app, key, value string) error {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	nonce := make([]byte, secretsAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := secretsAEAD.Seal(nonce, nonce, []byte(value), secretData(app, key))
+	if secrets[app] == nil {
+		secrets[app] = map[string]string{}
+	}
+	secrets[app][key] = base64.StdEncoding.EncodeToString(sealed)
+	return saveSecrets()
+}
+
+// unsetSecret returns false if there was no such secret
+func unsetSecret(app, key string) (bool, error) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	if _, ok := secrets[app][key]; !ok {
+		return false, nil
+	}
+	delete(secrets[app], key)
+	if len(secrets[app]) == 0 {
+		delete(secrets, app)
+	}
+	return true, saveSecrets()
+}
+
+// removeSecrets removes all secrets of a deleted app, so a new app with the same name does not get them
+func removeSecrets(app string) error {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	if _, ok := secrets[app]; !ok {
+		return nil
+	}
+	delete(secrets, app)
+	return saveSecrets()
+}
+
+func listSecrets(app string) []string {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	keys := []string{}
+	for key := range secrets[app] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// appSecrets returns the decrypted secrets of app as KEY=VALUE environment entries
+func appSecrets(app string) ([]string, error) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	env := []string{}
+	for key, value := range secrets[app] {
+		sealed, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		size := secretsAEAD.NonceSize()
+		if len(sealed) < size {
+			return nil, errors.New("bad secret: " + key)
+		}
+		plain, err := secretsAEAD.Open(nil, sealed[:size], sealed[size:], secretData(app, key))
+		if err != nil {
+			return nil, errors.New("unable to decrypt secret: " + key)
+		}
+		env = append(env, key+"="+string(plain))
+	}
+	sort.Strings(env)
+	return env, nil
+}
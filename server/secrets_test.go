@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// inTempDir runs the test in a temporary directory, the secrets files are relative to the working directory
+func inTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+func TestSecrets(t *testing.T) {
+	inTempDir(t)
+	secrets = map[string]map[string]string{}
+
+	// a missing key is created
+	if err := loadSecrets(); err != nil {
+		t.Fatal("oeps", err)
+	}
+	key, err := ioutil.ReadFile(*secretKeyFile)
+	stat, _ := os.Stat(*secretKeyFile)
+	if err != nil || len(key) != 32 || stat.Mode().Perm() != 0600 {
+		t.Fatal("oeps", len(key), err)
+	}
+
+	if err := setSecret("app", "DB", "s3cr3t"); err != nil {
+		t.Fatal("oeps", err)
+	}
+	if stored, _ := ioutil.ReadFile(secretsFile); bytes.Contains(stored, []byte("s3cr3t")) {
+		t.Fatal("oeps")
+	}
+	env, err := appSecrets("app")
+	if err != nil || len(env) != 1 || env[0] != "DB=s3cr3t" {
+		t.Fatal("oeps", env, err)
+	}
+
+	// loaded again with the same key
+	secrets = map[string]map[string]string{}
+	if err := loadSecrets(); err != nil {
+		t.Fatal("oeps", err)
+	}
+	if env, err := appSecrets("app"); err != nil || len(env) != 1 || env[0] != "DB=s3cr3t" {
+		t.Fatal("oeps", env, err)
+	}
+
+	// values are bound to their app and key
+	secrets["other"] = map[string]string{"DB": secrets["app"]["DB"]}
+	if _, err := appSecrets("other"); err == nil {
+		t.Fatal("oeps")
+	}
+	delete(secrets, "other")
+
+	// another key cannot decrypt them
+	if err := ioutil.WriteFile(*secretKeyFile, bytes.Repeat([]byte{1}, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secrets = map[string]map[string]string{}
+	if err := loadSecrets(); err != nil {
+		t.Fatal("oeps", err)
+	}
+	if _, err := appSecrets("app"); err == nil {
+		t.Fatal("oeps")
+	}
+
+	if err := ioutil.WriteFile(*secretKeyFile, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadSecrets(); err == nil {
+		t.Fatal("oeps")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"lambdaroach/shared"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+var appDir = flag.String("appdir", "/tmp", "directory for the files of app versions, uploads are staged in appdir/.staging")
+
+// stageApp creates the directory an upload is written to, it is only moved into place by commitApp once complete and
+// checked, so a failed upload never leaves a half written app behind
+func stageApp(id string) (string, error) {
+	staging := path.Join(*appDir, ".staging", id)
+	return staging, os.MkdirAll(staging, 0755)
+}
+
+// commandPath returns the executable of command, relative paths like ./server are in dir, others are looked up in PATH
+func commandPath(dir, command string) (string, error) {
+	name := strings.Split(command, " ")[0]
+	if strings.Contains(name, "/") && !path.IsAbs(name) {
+		name = path.Join(dir, name)
+	}
+	return exec.LookPath(name)
+}
+
+// checkApp checks an upload staged in dir can be activated
+func checkApp(app shared.AppMessage, dir string, pem, key []byte) error {
+	if app.Name == "" {
+		return errors.New("app has no name")
+	}
+	if err := shared.CheckEnv(app.Env); err != nil {
+		return err
+	}
+	for _, host := range app.Hosts {
+		if host == "" {
+			continue
+		}
+		if err := shared.CheckHost(host); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range app.Paths {
+		if err := shared.CheckPath(prefix); err != nil {
+			return err
+		}
+	}
+	if app.Rules != nil {
+		if err := app.Rules.Check(); err != nil {
+			return err
+		}
+	}
+	if app.Static != nil {
+		if err := app.Static.Check(); err != nil {
+			return err
+		}
+	}
+	if app.Compress != nil {
+		if err := app.Compress.Check(); err != nil {
+			return err
+		}
+	}
+	if err := hostConflict(app.Name, app.Hosts, app.Paths); err != nil {
+		return err
+	}
+	if app.TLS {
+		if _, err := tls.X509KeyPair(pem, key); err != nil {
+			return fmt.Errorf("bad certificate: %v", err)
+		}
+	}
+	if app.Command != "" {
+		if _, err := commandPath(dir, strings.Replace(app.Command, "${PORT}", "0", -1)); err != nil {
+			return fmt.Errorf("bad command: %v", err)
+		}
+	}
+	return nil
+}
+
+// commitApp moves a checked upload from staging into place, and returns the directory of the app version
+func commitApp(staging, id string) (string, error) {
+	base := path.Join(*appDir, id)
+	return base, os.Rename(staging, base)
+}
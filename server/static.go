@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"lambdaroach/shared"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// staticSite serves the files of an app without a command
+type staticSite struct {
+	dir     string
+	options shared.Static
+	cache   []shared.Ignore // patterns of options.Cache
+}
+
+func newStaticSite(dir string, options *shared.Static) *staticSite {
+	s := &staticSite{dir: dir}
+	if options != nil {
+		s.options = *options
+	}
+	for _, rule := range s.options.Cache {
+		pattern, _ := shared.ParseIgnore("", []string{rule.Path})
+		s.cache = append(s.cache, pattern)
+	}
+	return s
+}
+
+// isHidden checks if a path has an element starting with a dot, except for .well-known
+func isHidden(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if shared.StartsWith(elem, ".") && elem != ".well-known" {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding checks if the client accepts a content encoding like gzip, and did not set its q to 0
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(header, ",") {
+			params := strings.Split(part, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), encoding) {
+				continue
+			}
+			for _, param := range params[1:] {
+				param = strings.Replace(param, " ", "", -1)
+				if param == "q=0" || shared.StartsWith(param, "q=0.0") && strings.Trim(param[5:], "0") == "" {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (s *staticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := path.Clean("/" + r.URL.Path)
+	if isHidden(name) {
+		s.notFound(w, r)
+		return
+	}
+	stat, err := os.Stat(s.dir + name)
+	if err != nil {
+		// single page apps route paths like /users/1 themselves, missing files like /app.js are still not found
+		if s.options.SPA && path.Ext(name) == "" && s.serveIndex(w, r, "/") {
+			return
+		}
+		s.notFound(w, r)
+		return
+	}
+	if !stat.IsDir() {
+		s.serveFile(w, r, name, http.StatusOK)
+		return
+	}
+
+	// like http.FileServer, directories end in a slash, so relative links in their index work
+	if !shared.EndsWith(r.URL.Path, "/") {
+		target := path.Base(r.URL.Path) + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	if s.serveIndex(w, r, name) {
+		return
+	}
+	if s.options.Listing {
+		s.serveListing(w, name)
+		return
+	}
+	if s.options.SPA && s.serveIndex(w, r, "/") {
+		return
+	}
+	s.notFound(w, r)
+}
+
+// serveIndex serves the first index file of directory dir that exists, and returns false if there is none
+func (s *staticSite) serveIndex(w http.ResponseWriter, r *http.Request, dir string) bool {
+	for _, index := range s.options.Indexes() {
+		name := path.Join(dir, index)
+		if stat, err := os.Stat(s.dir + name); err == nil && stat.Mode().IsRegular() {
+			s.serveFile(w, r, name, http.StatusOK)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *staticSite) notFound(w http.ResponseWriter, r *http.Request) {
+	if s.options.NotFound != "" {
+		if stat, err := os.Stat(s.dir + s.options.NotFound); err == nil && stat.Mode().IsRegular() {
+			s.serveFile(w, r, s.options.NotFound, http.StatusNotFound)
+			return
+		}
+	}
+	http.Error(w, "404 Not Found", http.StatusNotFound)
+}
+
+// serveFile serves file name, or its precompressed .br or .gz sibling, with the cache-control of the first matching
+// rule, status other than 200 is for error pages, which are served as a whole and not cached
+func (s *staticSite) serveFile(w http.ResponseWriter, r *http.Request, name string, status int) {
+	header := w.Header()
+	for i, rule := range s.options.Cache {
+		if status == http.StatusOK && s.cache[i].Match(name, false) {
+			header.Set("Cache-Control", rule.Control)
+			break
+		}
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+
+	file := name
+	if s.options.Precompressed {
+		vary := false
+		for _, sibling := range []struct{ ext, encoding string }{{".br", "br"}, {".gz", "gzip"}} {
+			if _, err := os.Stat(s.dir + name + sibling.ext); err != nil {
+				continue
+			}
+			vary = true
+			if acceptsEncoding(r, sibling.encoding) {
+				file = name + sibling.ext
+				header.Set("Content-Encoding", sibling.encoding)
+				break
+			}
+		}
+		if vary {
+			header.Add("Vary", "Accept-Encoding")
+		}
+	}
+
+	in, err := os.Open(s.dir + file)
+	if err != nil {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if ctype != "" {
+		header.Set("Content-Type", ctype)
+	}
+	if status == http.StatusOK {
+		http.ServeContent(w, r, name, stat.ModTime(), in)
+		return
+	}
+	if ctype == "" {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	header.Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		io.Copy(w, in)
+	}
+}
+
+// serveListing lists the files of directory name, leaving out hidden files
+func (s *staticSite) serveListing(w http.ResponseWriter, name string) {
+	dir, err := os.Open(s.dir + name)
+	if err != nil {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return
+	}
+	defer dir.Close()
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<pre>\n")
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if shared.StartsWith(entryName, ".") {
+			continue
+		}
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		link := url.URL{Path: entryName}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", link.String(), html.EscapeString(entryName))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+func serveStatic(site *Site, w http.ResponseWriter, r *http.Request) {
+	if site.static == nil {
+		func() {
+			lock.Lock()
+			defer lock.Unlock()
+			static := http.Handler(newStaticSite(site.data, site.staticOptions))
+			site.static = &static
+		}()
+	}
+	static := *site.static
+	static.ServeHTTP(w, r)
+}
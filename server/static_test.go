@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"lambdaroach/shared"
+)
+
+// staticDir returns a directory with files, names ending in a slash are directories
+func staticDir(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, contents := range files {
+		name = path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// serveStaticRequest lets static site s handle a request, with headers as name, value pairs
+func serveStaticRequest(s *staticSite, method, url string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestStaticSite(t *testing.T) {
+	dir := staticDir(t, map[string]string{
+		"index.html":        "index",
+		"404.html":          "nf",
+		"app.js":            "js",
+		"assets/a.css":      "css",
+		".hidden":           "hidden",
+		"dir/.env":          "env",
+		".well-known/acme":  "acme",
+		"sub/x.txt":         "x",
+		"sub/.secret":       "secret",
+		"sub/index.htm/x":   "not an index",
+		"docs/default.html": "default",
+	})
+	s := newStaticSite(dir, &shared.Static{
+		SPA:      true,
+		NotFound: "/404.html",
+		Cache:    []shared.CacheRule{{Path: "/assets/**", Control: "max-age=31536000, immutable"}, {Path: "*.html", Control: "no-cache"}},
+	})
+
+	tests := []struct {
+		method, url string
+		status      int
+		body        string
+		cache       string
+	}{
+		{"GET", "/", 200, "index", "no-cache"},
+		{"GET", "/index.html", 200, "index", "no-cache"},
+		{"HEAD", "/app.js", 200, "", ""},
+		{"GET", "/assets/a.css", 200, "css", "max-age=31536000, immutable"},
+		// single page app routes are paths without an extension, missing files are not found
+		{"GET", "/users/1", 200, "index", "no-cache"},
+		{"GET", "/missing.js", 404, "nf", ""},
+		{"GET", "/assets/missing.css", 404, "nf", ""},
+		// hidden files are never served, .well-known is
+		{"GET", "/.hidden", 404, "nf", ""},
+		{"GET", "/dir/.env", 404, "nf", ""},
+		{"GET", "/dir/../.hidden", 404, "nf", ""},
+		{"GET", "/.well-known/acme", 200, "acme", ""},
+		// directories without an index are not listed, the single page app is served
+		{"GET", "/sub/", 200, "index", "no-cache"},
+		{"GET", "/sub/x.txt", 200, "x", ""},
+		{"POST", "/index.html", 405, "405 Method Not Allowed\n", ""},
+	}
+	for _, test := range tests {
+		w := serveStaticRequest(s, test.method, test.url)
+		if w.Code != test.status || w.Body.String() != test.body || w.Header().Get("Cache-Control") != test.cache {
+			t.Fatal("oeps", test.url, w.Code, w.Body.String(), w.Header())
+		}
+	}
+	if w := serveStaticRequest(s, "GET", "/missing.js"); w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatal("oeps", w.Header())
+	}
+	if w := serveStaticRequest(s, "GET", "/sub?a=b"); w.Code != 301 || w.Header().Get("Location") != "/sub/?a=b" {
+		t.Fatal("oeps", w.Code, w.Header())
+	}
+
+	// without spa and notfound
+	s = newStaticSite(dir, &shared.Static{Index: []string{"index.htm", "default.html"}})
+	for _, test := range []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"/", 404, "404 Not Found\n"},
+		{"/users/1", 404, "404 Not Found\n"},
+		// a directory named like an index is not one
+		{"/sub/", 404, "404 Not Found\n"},
+		{"/docs/", 200, "default"},
+		{"/.hidden", 404, "404 Not Found\n"},
+	} {
+		w := serveStaticRequest(s, "GET", test.url)
+		if w.Code != test.status || w.Body.String() != test.body {
+			t.Fatal("oeps", test.url, w.Code, w.Body.String())
+		}
+	}
+
+	// listing leaves out hidden files
+	s = newStaticSite(dir, &shared.Static{Listing: true})
+	w := serveStaticRequest(s, "GET", "/sub/")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `<a href="x.txt">x.txt</a>`) || strings.Contains(w.Body.String(), "secret") {
+		t.Fatal("oeps", w.Code, w.Body.String())
+	}
+}
+
+func TestStaticPrecompressed(t *testing.T) {
+	dir := staticDir(t, map[string]string{
+		"a.txt":    "plain",
+		"a.txt.br": "brotli",
+		"a.txt.gz": "gzip",
+		"b.txt":    "plain",
+		"b.txt.gz": "gzip",
+		"c.txt":    "plain",
+	})
+	s := newStaticSite(dir, &shared.Static{Precompressed: true})
+
+	tests := []struct {
+		url, accept, body, encoding, vary string
+	}{
+		{"/a.txt", "gzip, br", "brotli", "br", "Accept-Encoding"},
+		{"/a.txt", "gzip", "gzip", "gzip", "Accept-Encoding"},
+		{"/a.txt", "br;q=0, gzip", "gzip", "gzip", "Accept-Encoding"},
+		{"/a.txt", "br;q=0.000, gzip;q=0", "plain", "", "Accept-Encoding"},
+		{"/a.txt", "", "plain", "", "Accept-Encoding"},
+		{"/b.txt", "br", "plain", "", "Accept-Encoding"},
+		{"/b.txt", "GZIP;q=0.5", "gzip", "gzip", "Accept-Encoding"},
+		{"/c.txt", "gzip, br", "plain", "", ""},
+	}
+	for _, test := range tests {
+		w := serveStaticRequest(s, "GET", test.url, "Accept-Encoding", test.accept)
+		if w.Code != 200 || w.Body.String() != test.body || w.Header().Get("Content-Encoding") != test.encoding ||
+			w.Header().Get("Vary") != test.vary || w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+			t.Fatal("oeps", test.url, test.accept, w.Code, w.Body.String(), w.Header())
+		}
+	}
+
+	// without precompressed, the siblings are not looked at
+	if w := serveStaticRequest(newStaticSite(dir, nil), "GET", "/a.txt", "Accept-Encoding", "br"); w.Body.String() != "plain" {
+		t.Fatal("oeps", w.Body.String())
+	}
+}
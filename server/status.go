@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/x509"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recent errors of apps, for the status page
+const maxRecentErrors = 50
+
+type recentError struct {
+	Time time.Time
+	App  string
+	Msg  string
+}
+
+var recentErrorsLock = sync.Mutex{}
+var recentErrors = []recentError{}
+
+func recordError(app string, msg string) {
+	recentErrorsLock.Lock()
+	defer recentErrorsLock.Unlock()
+	recentErrors = append(recentErrors, recentError{time.Now(), app, msg})
+	if len(recentErrors) > maxRecentErrors {
+		recentErrors = recentErrors[len(recentErrors)-maxRecentErrors:]
+	}
+}
+
+// the status of apps, also used as is by the admin api
+type statusInstance struct {
+	ID      int32         `json:"id"`
+	Pid     int           `json:"pid"`
+	Addr    string        `json:"addr"`
+	Started time.Time     `json:"started"`
+	Uptime  time.Duration `json:"-"`
+	Working int64         `json:"working"`
+	Error   bool          `json:"error"`
+}
+
+type statusVersion struct {
+	Version   int             `json:"version"`
+	Latest    bool            `json:"latest"`
+	Hostnames []string        `json:"hostnames"`
+	Paths     []string        `json:"paths"`
+	Command   string          `json:"command"`
+	Data      string          `json:"data"`
+	HTTPSOnly bool            `json:"httpsonly"`
+	Running   *statusInstance `json:"running"`
+}
+
+type statusApp struct {
+	ID       string          `json:"name"`
+	Versions []statusVersion `json:"versions"`
+}
+
+type statusCert struct {
+	Names    []string
+	NotAfter time.Time
+	Days     int
+}
+
+type statusPage struct {
+	Now    time.Time
+	Apps   []*statusApp
+	Routes map[string][]string
+	Certs  []statusCert
+	Errors []recentError
+}
+
+func statusApps() ([]*statusApp, map[string][]string) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	apps := map[string]*statusApp{}
+	res := []*statusApp{}
+	latest := map[*Site]bool{}
+	for _, site := range latestSites {
+		latest[site] = true
+	}
+	for _, site := range sites {
+		app := apps[site.id]
+		if app == nil {
+			app = &statusApp{ID: site.id}
+			apps[site.id] = app
+			res = append(res, app)
+		}
+		version := statusVersion{
+			Version:   site.version,
+			Latest:    latest[site],
+			Hostnames: site.hostnames,
+			Paths:     site.paths,
+			Command:   site.command,
+			Data:      site.data,
+			HTTPSOnly: site.httpsOnly,
+		}
+		if run := site.running; run != nil {
+			version.Running = &statusInstance{
+				ID:      run.id,
+				Addr:    run.addr,
+				Started: run.start,
+				Uptime:  time.Since(run.start).Truncate(time.Second),
+				Working: atomic.LoadInt64(&run.working),
+				Error:   run.error,
+			}
+			if run.cmd != nil && run.cmd.Process != nil {
+				version.Running.Pid = run.cmd.Process.Pid
+			}
+		}
+		app.Versions = append(app.Versions, version)
+	}
+	for _, app := range res {
+		sort.Sort(byStatusVersion(app.Versions))
+	}
+	sort.Sort(byStatusID(res))
+
+	routed := map[string][]string{}
+	for host, sites := range routes {
+		for _, site := range sites {
+			routed[host] = append(routed[host], site.id)
+		}
+	}
+	return res, routed
+}
+
+type byStatusVersion []statusVersion
+
+func (a byStatusVersion) Len() int           { return len(a) }
+func (a byStatusVersion) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStatusVersion) Less(i, j int) bool { return a[i].Version > a[j].Version }
+
+type byStatusID []*statusApp
+
+func (a byStatusID) Len() int           { return len(a) }
+func (a byStatusID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStatusID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+func statusCerts() []statusCert {
+	tlsLock.RLock()
+	defer tlsLock.RUnlock()
+
+	res := []statusCert{}
+	for _, cert := range tlsConfig.Certificates {
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			log.Print("status: ", err)
+			continue
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 {
+			names = []string{leaf.Subject.CommonName}
+		}
+		res = append(res, statusCert{names, leaf.NotAfter, int(time.Until(leaf.NotAfter).Hours() / 24)})
+	}
+	return res
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{"join": strings.Join}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>lambdaroach status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { text-align: left; padding: 0.2em 0.8em; border-bottom: 1px solid #ddd; }
+.error { color: #c00; }
+.old { color: #888; }
+</style></head>
+<body>
+<h1>lambdaroach status</h1>
+<p>{{.Now.Format "2006-01-02 15:04:05 MST"}}</p>
+
+<h2>Apps</h2>
+{{range .Apps}}
+<h3>{{.ID}}</h3>
+<table>
+<tr><th>version</th><th>hostnames</th><th>paths</th><th>command</th><th>instance</th><th>pid</th><th>address</th><th>uptime</th><th>in flight</th></tr>
+{{range .Versions}}
+<tr{{if not .Latest}} class="old"{{end}}>
+<td>{{.Version}}{{if .HTTPSOnly}} (https only){{end}}</td>
+<td>{{join .Hostnames ", "}}</td>
+<td>{{join .Paths ", "}}</td>
+<td>{{if .Command}}{{.Command}}{{else}}<i>static</i>{{end}}</td>
+{{with .Running}}
+<td{{if .Error}} class="error"{{end}}>{{.ID}}{{if .Error}} (error){{end}}</td><td>{{.Pid}}</td><td>{{.Addr}}</td><td>{{.Uptime}}</td><td>{{.Working}}</td>
+{{else}}
+<td colspan="5"><i>not running</i></td>
+{{end}}
+</tr>
+{{end}}
+</table>
+{{else}}
+<p><i>no apps</i></p>
+{{end}}
+
+<h2>Routes</h2>
+<table>
+<tr><th>host</th><th>apps, newest first</th></tr>
+{{range $host, $apps := .Routes}}<tr><td>{{$host}}</td><td>{{join $apps ", "}}</td></tr>
+{{end}}
+</table>
+
+<h2>Certificates</h2>
+<table>
+<tr><th>names</th><th>expires</th><th>days left</th></tr>
+{{range .Certs}}<tr><td>{{join .Names ", "}}</td><td>{{.NotAfter.Format "2006-01-02"}}</td><td{{if lt .Days 14}} class="error"{{end}}>{{.Days}}</td></tr>
+{{end}}
+</table>
+
+<h2>Recent errors</h2>
+<table>
+<tr><th>time</th><th>app</th><th>error</th></tr>
+{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.App}}</td><td class="error">{{.Msg}}</td></tr>
+{{end}}
+</table>
+</body></html>
+`))
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := statusPage{Now: time.Now(), Certs: statusCerts()}
+	page.Apps, page.Routes = statusApps()
+	func() {
+		recentErrorsLock.Lock()
+		defer recentErrorsLock.Unlock()
+		// newest first
+		for i := len(recentErrors) - 1; i >= 0; i-- {
+			page.Errors = append(page.Errors, recentErrors[i])
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, page); err != nil {
+		log.Print("status: ", err)
+	}
+}
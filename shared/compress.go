@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed data frames hold a chunk of at most MaxDataFrame bytes of a file, compressed on its own, so a receiver
+// never has to decompress more than that per frame. Chunks that don't get smaller are sent as plain data frames.
+const (
+	FrameGzip byte = 'G'
+	FrameZstd byte = 'Z'
+)
+
+// compression capabilities, most preferred first
+var compressions = []struct {
+	capability string
+	kind       byte
+}{
+	{CapZstd, FrameZstd},
+	{CapGzip, FrameGzip},
+}
+
+// gzip writers are reused, a new one allocates a lot, and data is compressed per chunk
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+		zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecodeAllCapLimit(true),
+			zstd.WithDecoderMaxMemory(MaxDataFrame))
+		if err != nil {
+			panic(err)
+		}
+	})
+}
+
+// compress returns p compressed as kind
+func compress(kind byte, p []byte) ([]byte, error) {
+	switch kind {
+	case FrameZstd:
+		initZstd()
+		return zstdEncoder.EncodeAll(p, nil), nil
+	case FrameGzip:
+		var buf bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer func() {
+			w.Reset(nil)
+			gzipWriters.Put(w)
+		}()
+		w.Reset(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		err := w.Close()
+		return buf.Bytes(), err
+	}
+	return p, nil
+}
+
+// decompress returns the contents of a data frame of kind, at most MaxDataFrame bytes
+func decompress(kind byte, payload []byte) ([]byte, error) {
+	switch kind {
+	case FrameZstd:
+		initZstd()
+		return zstdDecoder.DecodeAll(payload, make([]byte, 0, MaxDataFrame))
+	case FrameGzip:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(r, MaxDataFrame+1))
+		if err == nil && len(data) > MaxDataFrame {
+			err = errors.New("data frame too large")
+		}
+		return data, err
+	}
+	return payload, nil
+}
+
+// SetCompression compresses the data frames written with the most preferred compression in the negotiated hello,
+// it returns the capability used, or empty for none
+func (c *Conn) SetCompression(hello Hello) string {
+	for _, compression := range compressions {
+		if hello.Has(compression.capability) {
+			c.compression = compression.kind
+			return compression.capability
+		}
+	}
+	return ""
+}
+
+// DataCounts returns the bytes of file contents written, and the bytes of data frames that were sent for them
+func (c *Conn) DataCounts() (data, sent int64) {
+	return c.dataBytes, c.sentBytes
+}
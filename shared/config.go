@@ -0,0 +1,251 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Config for lambda.config.json
+type Config struct {
+	Name        string    `json:"name"`        // name of site, must be unique
+	Hostname    string    `json:"hostname"`    // hostname of site
+	Hostnames   []string  `json:"hostnames"`   // more hostnames, like www. aliases, or wildcards like *.example.com
+	Paths       []string  `json:"paths"`       // path prefixes the app serves, like /api, default is /
+	StripPath   bool      `json:"strippath"`   // remove the path prefix before forwarding requests to the app
+	Rules       *Rules    `json:"rules"`       // redirects, rewrites and headers of requests
+	Static      *Static   `json:"static"`      // options of static sites
+	Compress    *Compress `json:"compress"`    // compress responses for clients that accept it
+	Command     string    `json:"command"`     // command to run, null or "" to serve as static site
+	Env         []string  `json:"env"`         // environment variables added to command
+	Certificate *string   `json:"certificate"` // to configure tls, the public key
+	PrivateKey  *string   `json:"privatekey"`  // to configure tls, the private key
+	LetsEncrypt *string   `json:"letsencrypt"` // to configure tls using letsencrypt, your email
+	HTTPSOnly   bool      `json:"httpsonly"`   // if site opened using http, redirect to https immediately
+	Include     []string  `json:"include"`     // patterns of files to upload even if ignored, like hidden files
+	Exclude     []string  `json:"exclude"`     // patterns of files not to upload, like in .roachignore
+	GitIgnore   bool      `json:"gitignore"`   // also skip the files ignored by .gitignore files
+}
+
+// Static are the options of static sites, apps without a command. Hidden files are never served.
+type Static struct {
+	Index         []string    `json:"index,omitempty"`         // index files of directories, default is index.html
+	Listing       bool        `json:"listing,omitempty"`       // list directories without an index file
+	SPA           bool        `json:"spa,omitempty"`           // serve /index.html for paths without extension that don't exist
+	NotFound      string      `json:"notfound,omitempty"`      // page served for paths that don't exist, like /404.html
+	Cache         []CacheRule `json:"cache,omitempty"`         // cache-control of files, the first matching rule wins
+	Precompressed bool        `json:"precompressed,omitempty"` // serve file.br or file.gz instead of file if accepted
+}
+
+// CacheRule sets the Cache-Control header of the files matching Path, a .roachignore style pattern like *.js or
+// /assets/**
+type CacheRule struct {
+	Path    string `json:"path"`
+	Control string `json:"control"`
+}
+
+// Indexes returns the index files of directories
+func (static Static) Indexes() []string {
+	if len(static.Index) == 0 {
+		return []string{"index.html"}
+	}
+	return static.Index
+}
+
+// Check checks the options are valid
+func (static Static) Check() error {
+	for _, index := range static.Index {
+		if index == "" || strings.Contains(index, "/") || StartsWith(index, ".") {
+			return errors.New("bad index file: " + index)
+		}
+	}
+	if static.NotFound != "" && (!StartsWith(static.NotFound, "/") || strings.Contains(static.NotFound, "/.")) {
+		return errors.New("bad notfound page: " + static.NotFound)
+	}
+	for _, rule := range static.Cache {
+		if _, err := ParseIgnore("", []string{rule.Path}); err != nil || strings.TrimSpace(rule.Path) == "" {
+			return errors.New("bad cache path: " + rule.Path)
+		}
+		if strings.ContainsAny(rule.Control, "\r\n") {
+			return errors.New("bad cache control: " + rule.Control)
+		}
+	}
+	return nil
+}
+
+// Compress are the options of compressing responses on the fly, responses the app encoded itself are sent as is
+type Compress struct {
+	Encodings []string `json:"encodings,omitempty"` // br and gzip, most preferred first, default is both
+	MinSize   int      `json:"minsize,omitempty"`   // smallest response compressed in bytes, default is 1024
+	Types     []string `json:"types,omitempty"`     // content types compressed, like text/*, default is CompressTypes
+}
+
+// CompressTypes are the content types compressed by default
+var CompressTypes = []string{"text/*", "application/json", "application/*+json", "application/javascript",
+	"application/xml", "application/*+xml", "image/svg+xml", "application/wasm"}
+
+// Preference returns the encodings to use, most preferred first
+func (compress Compress) Preference() []string {
+	if len(compress.Encodings) == 0 {
+		return []string{"br", "gzip"}
+	}
+	return compress.Encodings
+}
+
+// Threshold returns the size of the smallest response that is compressed
+func (compress Compress) Threshold() int {
+	if compress.MinSize == 0 {
+		return 1024
+	}
+	return compress.MinSize
+}
+
+// Compressible checks if responses of a content type like "text/html; charset=utf-8" are compressed
+func (compress Compress) Compressible(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "" {
+		return false
+	}
+	types := compress.Types
+	if len(types) == 0 {
+		types = CompressTypes
+	}
+	for _, pattern := range types {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check checks the options are valid
+func (compress Compress) Check() error {
+	for _, encoding := range compress.Encodings {
+		if encoding != "br" && encoding != "gzip" {
+			return errors.New("bad compress encoding, use br or gzip: " + encoding)
+		}
+	}
+	if compress.MinSize < 0 {
+		return errors.New("bad compress minsize")
+	}
+	for _, pattern := range compress.Types {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return errors.New("bad compress type: " + pattern)
+		}
+	}
+	return nil
+}
+
+// Ignore returns the patterns of the exclude list, followed by the include list, so includes win
+func (config Config) Ignore() (Ignore, error) {
+	ignore, err := ParseIgnore("", config.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("bad 'exclude': %v", err)
+	}
+	includes := []string{}
+	for _, include := range config.Include {
+		includes = append(includes, "!"+include)
+	}
+	include, err := ParseIgnore("", includes)
+	if err != nil {
+		return nil, fmt.Errorf("bad 'include': %v", err)
+	}
+	return append(ignore, include...), nil
+}
+
+// Hosts returns hostname followed by hostnames, cleaned like CleanHosts
+func (config Config) Hosts() []string {
+	hosts := []string{}
+	for _, host := range append([]string{config.Hostname}, config.Hostnames...) {
+		if host != "" || len(config.Hostnames) == 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	return CleanHosts(hosts)
+}
+
+// CleanHosts returns hosts lower case, without a trailing dot and without duplicates, like requests are matched
+func CleanHosts(hosts []string) []string {
+	clean := []string{}
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if !seen[host] {
+			seen[host] = true
+			clean = append(clean, host)
+		}
+	}
+	return clean
+}
+
+// AppMessage returns the message to upload the app as described by the config
+func (config Config) AppMessage(version string) (AppMessage, error) {
+	app := AppMessage{
+		Name:      config.Name,
+		Version:   version,
+		Command:   config.Command,
+		Hosts:     config.Hosts(),
+		Env:       config.Env,
+		StripPath: config.StripPath,
+		Rules:     config.Rules,
+		Static:    config.Static,
+		Compress:  config.Compress,
+	}
+	for _, prefix := range config.Paths {
+		if prefix != "/" {
+			prefix = strings.TrimSuffix(prefix, "/")
+		}
+		app.Paths = append(app.Paths, prefix)
+	}
+	if config.Name == "" {
+		return app, errors.New("missing 'name'")
+	}
+	for _, host := range app.Hosts {
+		if host == "" {
+			continue
+		}
+		if err := CheckHost(host); err != nil {
+			return app, err
+		}
+	}
+	for _, prefix := range app.Paths {
+		if err := CheckPath(prefix); err != nil {
+			return app, err
+		}
+	}
+	if config.Rules != nil {
+		if err := config.Rules.Check(); err != nil {
+			return app, err
+		}
+	}
+	if config.Static != nil {
+		if err := config.Static.Check(); err != nil {
+			return app, err
+		}
+	}
+	if config.Compress != nil {
+		if err := config.Compress.Check(); err != nil {
+			return app, err
+		}
+	}
+	if err := CheckEnv(config.Env); err != nil {
+		return app, err
+	}
+
+	// use tls if appropriate
+	if config.Certificate != nil && config.PrivateKey != nil {
+		if config.LetsEncrypt != nil {
+			return app, errors.New("cannot configure both 'certificate'/'privatekey' and 'letsencrypt'")
+		}
+		app.TLS = true
+		app.HTTPSOnly = config.HTTPSOnly
+	}
+
+	// or use letsencrypt
+	if config.LetsEncrypt != nil {
+		app.LetsEncryptEmail = *config.LetsEncrypt
+		app.HTTPSOnly = config.HTTPSOnly
+	}
+	return app, nil
+}
@@ -0,0 +1,206 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Since protocol version 3 messages are sent as frames: a type byte, a big endian uint32 length and the payload.
+// Messages are json frames, the contents of files are sent as data frames following the message announcing them.
+const (
+	FrameJSON byte = 'J'
+	FrameData byte = 'D'
+)
+
+// MaxMessageSize is the largest json message accepted, both framed and NUL terminated
+const MaxMessageSize = 4 * 1024 * 1024
+
+// MaxDataFrame is the largest payload of a data frame
+const MaxDataFrame = 64 * 1024
+
+// FramedProtocolVersion is the first protocol version using frames
+const FramedProtocolVersion = 3
+
+// ErrTooLarge is returned for messages or frames larger than their maximum size
+var ErrTooLarge = errors.New("message too large")
+
+// WriteFrame writes a frame with payload
+func WriteFrame(w io.Writer, kind byte, payload []byte) error {
+	if len(payload) > MaxMessageSize {
+		return ErrTooLarge
+	}
+	header := [5]byte{kind}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadFrame reads a frame, with a payload of at most max bytes
+func ReadFrame(r io.Reader, max int) (kind byte, payload []byte, err error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	kind = header[0]
+	switch kind {
+	case FrameJSON, FrameData, FrameGzip, FrameZstd:
+	default:
+		return 0, nil, fmt.Errorf("unknown frame type: %d", kind)
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > uint32(max) {
+		return 0, nil, ErrTooLarge
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return kind, payload, nil
+}
+
+// Conn reads and writes the messages of the admin protocol, NUL terminated json, or frames once SetFramed is called
+// after negotiating protocol version 3 or later with Hello
+type Conn struct {
+	in          *bufio.Reader
+	out         io.Writer
+	framed      bool
+	compression byte  // frame type of compressed data frames, 0 for none
+	dataBytes   int64 // bytes of file contents written
+	sentBytes   int64 // bytes sent for them
+}
+
+// NewConn returns a Conn using NUL terminated json
+func NewConn(in *bufio.Reader, out io.Writer) *Conn {
+	return &Conn{in: in, out: out}
+}
+
+// SetFramed switches to frames
+func (c *Conn) SetFramed() {
+	c.framed = true
+}
+
+// Framed checks if frames are used
+func (c *Conn) Framed() bool {
+	return c.framed
+}
+
+// Reader returns the underlying reader, for example to notice the peer closing the connection
+func (c *Conn) Reader() *bufio.Reader {
+	return c.in
+}
+
+// ReadJSON reads a message
+func (c *Conn) ReadJSON(v interface{}) error {
+	if !c.framed {
+		return ReadJSON0(c.in, v)
+	}
+	kind, payload, err := ReadFrame(c.in, MaxMessageSize)
+	if err != nil {
+		return err
+	}
+	if kind != FrameJSON {
+		return fmt.Errorf("expected a json frame, got: %c", kind)
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// WriteJSON writes a message
+func (c *Conn) WriteJSON(v interface{}) error {
+	if !c.framed {
+		return WriteJSON0(c.out, v)
+	}
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(c.out, FrameJSON, bytes)
+}
+
+// Write writes the contents of a file, announced by the message written before, as data frames
+func (c *Conn) Write(p []byte) (int, error) {
+	if !c.framed {
+		written, err := c.out.Write(p)
+		c.dataBytes += int64(written)
+		c.sentBytes += int64(written)
+		return written, err
+	}
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > MaxDataFrame {
+			n = MaxDataFrame
+		}
+		kind, payload := FrameData, p[written:written+n]
+		if c.compression != 0 {
+			compressed, err := compress(c.compression, payload)
+			if err != nil {
+				return written, err
+			}
+			if len(compressed) < len(payload) {
+				kind, payload = c.compression, compressed
+			}
+		}
+		if err := WriteFrame(c.out, kind, payload); err != nil {
+			return written, err
+		}
+		written += n
+		c.dataBytes += int64(n)
+		c.sentBytes += int64(5 + len(payload))
+	}
+	return written, nil
+}
+
+// Data returns a reader of the size bytes of a file, announced by the message read before
+func (c *Conn) Data(size int64) io.Reader {
+	if !c.framed {
+		return io.LimitReader(c.in, size)
+	}
+	return &dataReader{c: c, left: size}
+}
+
+// dataReader reads the payload of data frames, until left bytes are read
+type dataReader struct {
+	c    *Conn
+	buf  []byte
+	left int64
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	if d.left <= 0 {
+		return 0, io.EOF
+	}
+	for len(d.buf) == 0 {
+		kind, payload, err := ReadFrame(d.c.in, MaxDataFrame)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if kind == FrameJSON {
+			return 0, errors.New("expected a data frame, got a message")
+		}
+		payload, err = decompress(kind, payload)
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(payload)) > d.left {
+			return 0, errors.New("data frame larger than announced")
+		}
+		d.buf = payload
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	d.left -= int64(n)
+	return n, nil
+}
@@ -0,0 +1,108 @@
+package shared
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// IgnoreFile is the name of the files with gitignore style patterns of files roachctl does not upload
+const IgnoreFile = ".roachignore"
+
+// IgnorePattern is a gitignore style pattern
+type IgnorePattern struct {
+	base     string   // directory of the ignore file the pattern is from, relative to the app, "" for the app itself
+	segments []string // glob per path element, "**" matches any number of elements
+	negate   bool     // pattern started with !, matching files are not ignored
+	dir      bool     // pattern ended with /, only matches directories
+}
+
+// Ignore is a list of patterns, the last pattern matching a file decides if it is ignored
+type Ignore []IgnorePattern
+
+// ParseIgnore parses the lines of an ignore file in directory base, relative to the app. Like gitignore, blank lines
+// and lines starting with # are skipped, ! negates a pattern, a trailing / only matches directories, and patterns with
+// a / in the beginning or middle are relative to base, others match files and directories at any level below it.
+func ParseIgnore(base string, lines []string) (Ignore, error) {
+	ignore := Ignore{}
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p := IgnorePattern{base: strings.Trim(base, "/")}
+		if line[0] == '!' {
+			p.negate = true
+			line = line[1:]
+		} else if StartsWith(line, "\\#") || StartsWith(line, "\\!") {
+			line = line[1:]
+		}
+		if EndsWith(line, "/") {
+			p.dir = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		anchored := strings.Contains(line, "/")
+		p.segments = strings.Split(strings.TrimLeft(line, "/"), "/")
+		if !anchored {
+			p.segments = append([]string{"**"}, p.segments...)
+		}
+		for _, segment := range p.segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, errors.New("bad pattern: " + line)
+			}
+		}
+		ignore = append(ignore, p)
+	}
+	return ignore, nil
+}
+
+// Match checks if the file or directory name, relative to the app, is ignored. Only name itself is matched, like git
+// the caller should not look inside ignored directories, files in them cannot be included again.
+func (ignore Ignore) Match(name string, isdir bool) bool {
+	name = strings.Trim(name, "/")
+	ignored := false
+	for _, p := range ignore {
+		if p.dir && !isdir {
+			continue
+		}
+		rel := name
+		if p.base != "" {
+			if !StartsWith(name, p.base+"/") {
+				continue
+			}
+			rel = name[len(p.base)+1:]
+		}
+		if matchSegments(p.segments, strings.Split(rel, "/")) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches the elements of a path against the globs of a pattern
+func matchSegments(pattern, elems []string) bool {
+	if len(pattern) == 0 {
+		return len(elems) == 0
+	}
+	if pattern[0] == "**" {
+		// a trailing ** matches everything inside a directory, but not the directory itself
+		min := 0
+		if len(pattern) == 1 {
+			min = 1
+		}
+		for i := min; i <= len(elems); i++ {
+			if matchSegments(pattern[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], elems[0])
+	return ok && matchSegments(pattern[1:], elems[1:])
+}
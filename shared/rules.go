@@ -0,0 +1,143 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Rules are applied to the requests of an app before they are forwarded to it, or served as static files. Paths are
+// the full paths of requests, including a path prefix the app is mounted at.
+type Rules struct {
+	CanonicalHost   string      `json:"canonicalhost,omitempty"` // redirect requests for other hostnames to this one
+	Redirects       []Redirect  `json:"redirects,omitempty"`
+	Rewrites        []Rewrite   `json:"rewrites,omitempty"`
+	RequestHeaders  HeaderRules `json:"requestheaders,omitempty"`  // changed before forwarding a request to the app
+	ResponseHeaders HeaderRules `json:"responseheaders,omitempty"` // changed before sending a response to the client
+}
+
+// Redirect redirects requests for path From to To. A From ending in * matches all paths starting with the part before
+// it, and a * in To is replaced by the rest of the path. To is a path or a full URL, the query of the request is kept
+// if To has none.
+type Redirect struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Status int    `json:"status,omitempty"` // 301, 302, 303, 307 or 308, default is 301
+}
+
+// Rewrite serves path To instead of From, without the client noticing, matched like a Redirect
+type Rewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// HeaderRules sets and removes headers
+type HeaderRules struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// headers that are part of the connection or the framing of messages, and cannot be changed by rules
+var fixedHeaders = []string{"Host", "Connection", "Content-Length", "Transfer-Encoding", "Upgrade", "Trailer"}
+
+// MatchRule returns the target of a rule from/to for path, and if path matches from. Repeated slashes in the part of
+// path matched by * are collapsed, also with a slash before the *, and it cannot turn a target that is a path into
+// another host, which browsers take //host and /\host for, so /old//evil.example with /old/* and /* goes to
+// /evil.example, and /old/\evil.example does not match.
+func MatchRule(from, to, path string) (string, bool) {
+	if !EndsWith(from, "*") {
+		return to, path == from
+	}
+	prefix := from[:len(from)-1]
+	if !StartsWith(path, prefix) {
+		return "", false
+	}
+	rest := path[len(prefix):]
+	for strings.Contains(rest, "//") {
+		rest = strings.Replace(rest, "//", "/", -1)
+	}
+	if i := strings.Index(to, "*"); i > 0 && to[i-1] == '/' {
+		rest = strings.TrimPrefix(rest, "/")
+	}
+	target := strings.Replace(to, "*", rest, 1)
+	if !strings.Contains(to, "://") && !StartsWith(to, "//") &&
+		(StartsWith(target, "//") || StartsWith(target, "/\\")) {
+		return "", false
+	}
+	return target, true
+}
+
+// Apply removes and then sets the headers in h
+func (rules HeaderRules) Apply(h http.Header) {
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+	for name, value := range rules.Set {
+		h.Set(name, value)
+	}
+}
+
+// Check checks the header names are valid, and can be changed
+func (rules HeaderRules) Check() error {
+	names := append([]string{}, rules.Remove...)
+	for name := range rules.Set {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:()<>@,;\\\"/[]?={}") {
+			return errors.New("bad header name: " + name)
+		}
+		for _, fixed := range fixedHeaders {
+			if http.CanonicalHeaderKey(name) == fixed {
+				return errors.New("header cannot be changed: " + name)
+			}
+		}
+	}
+	for name, value := range rules.Set {
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("bad value of header: " + name)
+		}
+	}
+	return nil
+}
+
+// Check checks the rules are valid
+func (rules Rules) Check() error {
+	if rules.CanonicalHost != "" {
+		if err := CheckHost(rules.CanonicalHost); err != nil || StartsWith(rules.CanonicalHost, "*.") {
+			return errors.New("bad canonicalhost: " + rules.CanonicalHost)
+		}
+	}
+	for _, redirect := range rules.Redirects {
+		if !StartsWith(redirect.From, "/") || redirect.To == "" || strings.ContainsAny(redirect.To, "\r\n") {
+			return fmt.Errorf("bad redirect: %s -> %s", redirect.From, redirect.To)
+		}
+		// the rest of a path replacing * in a URL must not change its host, like https://example.com* would
+		if i := strings.Index(redirect.To, "*"); i >= 0 && strings.Contains(redirect.To[:i], "://") {
+			u, err := url.Parse(redirect.To[:i])
+			if err != nil || u.Host == "" || !StartsWith(u.Path, "/") {
+				return fmt.Errorf("bad redirect, * must be in the path of the url: %s -> %s", redirect.From, redirect.To)
+			}
+		}
+		switch redirect.Status {
+		case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect,
+			http.StatusPermanentRedirect:
+		default:
+			return fmt.Errorf("bad status of redirect: %s, %d", redirect.From, redirect.Status)
+		}
+	}
+	for _, rewrite := range rules.Rewrites {
+		if !StartsWith(rewrite.From, "/") || !StartsWith(rewrite.To, "/") || strings.ContainsAny(rewrite.To, "?#") {
+			return fmt.Errorf("bad rewrite: %s -> %s", rewrite.From, rewrite.To)
+		}
+	}
+	if err := rules.RequestHeaders.Check(); err != nil {
+		return fmt.Errorf("bad requestheaders: %v", err)
+	}
+	if err := rules.ResponseHeaders.Check(); err != nil {
+		return fmt.Errorf("bad responseheaders: %v", err)
+	}
+	return nil
+}
@@ -2,11 +2,226 @@ package shared
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
 )
 
+// Op is read from the first message of an admin connection, an empty op means an app upload using AppMessage
+type Op struct {
+	Op string `json:"op"`
+}
+
+// admin operations
+const (
+	OpSecretSet   = "secret-set"
+	OpSecretUnset = "secret-unset"
+	OpSecretList  = "secret-list"
+	OpUpdate      = "update"
+	OpLogs        = "logs"
+	OpEvents      = "events"
+	OpHello       = "hello"
+	OpDiff        = "diff"
+)
+
+// ProtocolVersion is the version of the admin protocol, version 1 is the protocol before Hello was added
+const ProtocolVersion = 3
+
+// MinProtocolVersion is the oldest version of the admin protocol still supported
+const MinProtocolVersion = 1
+
+// capabilities of peers, negotiated with Hello
+const (
+	CapIncremental = "incremental" // uploads with a Manifest
+	CapArchive     = "archive"     // uploads of an archive
+	CapDigest      = "digest"      // file hashes and the digest of uploads
+	CapZstd        = "zstd"        // zstd compressed data frames
+	CapGzip        = "gzip"        // gzip compressed data frames
+	CapDiff        = "diff"        // OpDiff
+	CapDryRun      = "dryrun"      // uploads with AppMessage.DryRun
+	CapPaths       = "paths"       // apps with AppMessage.Paths
+	CapRules       = "rules"       // apps with AppMessage.Rules
+	CapStatic      = "static"      // apps with AppMessage.Static
+	CapCompress    = "compress"    // apps with AppMessage.Compress
+)
+
+// AuthLocal means the admin port only listens on localhost, clients connect locally or through ssh
+const AuthLocal = "local"
+
+// Hello is optionally the first message of an admin connection, replied to with a Status and the negotiated Hello,
+// after which the connection continues with the first message of an op
+type Hello struct {
+	Op           string   `json:"op"`
+	Protocol     int      `json:"protocol"`
+	MinProtocol  int      `json:"minprotocol"`
+	Capabilities []string `json:"capabilities"`
+	Auth         []string `json:"auth"` // supported auth methods, most preferred first
+}
+
+// capabilities of this version
+var capabilities = []string{CapIncremental, CapArchive, CapDigest, CapZstd, CapGzip, CapDiff, CapDryRun, CapPaths,
+	CapRules, CapStatic, CapCompress}
+
+// NewHello returns the Hello of this version of the protocol
+func NewHello() Hello {
+	return Hello{
+		Op:           OpHello,
+		Protocol:     ProtocolVersion,
+		MinProtocol:  MinProtocolVersion,
+		Capabilities: append([]string{}, capabilities...),
+		Auth:         []string{AuthLocal},
+	}
+}
+
+// Has checks if capability was negotiated
+func (h Hello) Has(capability string) bool {
+	for _, c := range h.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the Hello both peers can use, the lowest protocol version, the common capabilities, and the most
+// preferred auth method of local that remote supports, or an error if the peers are incompatible
+func Negotiate(local, remote Hello) (Hello, error) {
+	res := Hello{Op: OpHello, Protocol: local.Protocol, MinProtocol: local.MinProtocol, Capabilities: []string{}}
+	if remote.Protocol < res.Protocol {
+		res.Protocol = remote.Protocol
+	}
+	if remote.MinProtocol > res.MinProtocol {
+		res.MinProtocol = remote.MinProtocol
+	}
+	if res.Protocol < res.MinProtocol {
+		return res, fmt.Errorf("incompatible protocol versions, %d-%d and %d-%d, upgrade the older of roachctl and lambdaroach",
+			local.MinProtocol, local.Protocol, remote.MinProtocol, remote.Protocol)
+	}
+	for _, c := range local.Capabilities {
+		if remote.Has(c) {
+			res.Capabilities = append(res.Capabilities, c)
+		}
+	}
+	for _, a := range local.Auth {
+		for _, b := range remote.Auth {
+			if a == b && len(res.Auth) == 0 {
+				res.Auth = []string{a}
+			}
+		}
+	}
+	if len(res.Auth) == 0 {
+		return res, fmt.Errorf("no common auth method, %v and %v", local.Auth, remote.Auth)
+	}
+	return res, nil
+}
+
+// event types in the journal of the server
+const (
+	EventDeployed     = "deployed"
+	EventLaunched     = "launched"
+	EventLaunchFailed = "launch-failed"
+	EventHealthFailed = "health-failed"
+	EventStopped      = "stopped"
+	EventCrashed      = "crashed"
+	EventRolledBack   = "rolled-back"
+	EventCertAdded    = "cert-added"
+	EventCertRemoved  = "cert-removed"
+	EventDeleted      = "deleted"
+)
+
+// SecretMessage sets, unsets or lists the secrets of app Name, replied to with a Status
+type SecretMessage struct {
+	Op    string `json:"op"`
+	Name  string `json:"name"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// SecretList follows the Status of OpSecretList, it only contains the keys, never the values
+type SecretList struct {
+	Keys []string `json:"keys"`
+}
+
+// UpdateMessage creates a new version of app Name using the files of its current version, with modified env or
+// command, replied to with a Status and if ok an Accept
+type UpdateMessage struct {
+	Op      string   `json:"op"`
+	Name    string   `json:"name"`
+	Env     []string `json:"env,omitempty"`     // KEY=VALUE entries to add or replace
+	Unset   []string `json:"unset,omitempty"`   // KEYs to remove
+	Command *string  `json:"command,omitempty"` // replaces the command if not nil
+}
+
+// LogsMessage queries the logs of app Name, replied to with a Status, and LogLines ending with an empty LogLine
+type LogsMessage struct {
+	Op     string    `json:"op"`
+	Name   string    `json:"name"`
+	Since  time.Time `json:"since"`            // zero means from the start
+	Until  time.Time `json:"until"`            // zero means until now
+	Stream string    `json:"stream,omitempty"` // "stdout" or "stderr", empty for both
+	Limit  int       `json:"limit,omitempty"`  // only the last Limit lines, zero for no limit
+	Follow bool      `json:"follow,omitempty"` // keep streaming new lines until the connection closes, no empty LogLine
+	Access bool      `json:"access,omitempty"` // when following, also stream the access log of the app, as stream "access"
+}
+
+// LogLine is a line written by an app instance to its stdout or stderr, or an access log line of the app
+type LogLine struct {
+	Time     time.Time `json:"time"`
+	App      string    `json:"app"`
+	Version  int       `json:"version"`
+	Instance int32     `json:"instance"`
+	Stream   string    `json:"stream"`
+	Line     string    `json:"line"`
+}
+
+// Event is an entry in the journal of app lifecycle events kept by the server
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	App      string    `json:"app,omitempty"`
+	Version  int       `json:"version,omitempty"`
+	Instance int32     `json:"instance,omitempty"`
+	Msg      string    `json:"msg,omitempty"` // like the reason of a stop, or the exit status of a crash
+}
+
+// EventsMessage queries the journal, replied to with a Status, and Events ending with an empty Event
+type EventsMessage struct {
+	Op    string    `json:"op"`
+	Name  string    `json:"name,omitempty"`  // only events of this app, empty for all events
+	Type  string    `json:"type,omitempty"`  // only events of this type, empty for all types
+	Since time.Time `json:"since"`           // zero means from the start
+	Limit int       `json:"limit,omitempty"` // only the last Limit events, zero for no limit
+}
+
+// DiffMessage asks for the active version of app Name, replied to with a Status and Deployed
+type DiffMessage struct {
+	Op   string `json:"op"`
+	Name string `json:"name"`
+}
+
+// Deployed describes the active version of an app, with the Manifest of its files
+type Deployed struct {
+	Version   int       `json:"version"`
+	Command   string    `json:"command"`
+	Hosts     []string  `json:"hosts"`
+	Paths     []string  `json:"paths"`
+	StripPath bool      `json:"strippath"`
+	Rules     *Rules    `json:"rules,omitempty"`
+	Static    *Static   `json:"static,omitempty"`
+	Compress  *Compress `json:"compress,omitempty"`
+	Env       []string  `json:"env"`
+	HTTPSOnly bool      `json:"httpsonly"`
+	Manifest  Manifest  `json:"manifest"`
+}
+
 // AppMessage ...
 type AppMessage struct {
 	Name             string   `json:"name"`
@@ -17,12 +232,30 @@ type AppMessage struct {
 	TLS              bool     `json:"tls"`
 	LetsEncryptEmail string   `json:"letsencryptmail"`
 	HTTPSOnly        bool     `json:"httpsonly"`
+	// Incremental asks to upload a Manifest, and only the files the server does not have yet
+	Incremental bool `json:"incremental,omitempty"`
+	// DryRun checks the upload like a deploy, but discards it instead of activating it
+	DryRun bool `json:"dryrun,omitempty"`
+	// Paths are the path prefixes the app serves on its hosts, empty means /, with StripPath the prefix is removed
+	// from requests before forwarding them
+	Paths     []string `json:"paths,omitempty"`
+	StripPath bool     `json:"strippath,omitempty"`
+	// Rules are applied to requests before forwarding them to the app
+	Rules *Rules `json:"rules,omitempty"`
+	// Static are the options of static sites
+	Static *Static `json:"static,omitempty"`
+	// Compress enables compressing responses, with its options
+	Compress *Compress `json:"compress,omitempty"`
+	// PrivateFiles are the certificate and private key in an archive, the server removes them so they are not served
+	PrivateFiles []string `json:"privatefiles,omitempty"`
 }
 
 // Accept ...
 type Accept struct {
 	Version int    `json:"version"`
 	ID      string `json:"id"`
+	// Incremental is set if the server accepts an incremental upload, old servers leave it out
+	Incremental bool `json:"incremental,omitempty"`
 }
 
 // FileMessage ...
@@ -30,12 +263,223 @@ type FileMessage struct {
 	Name string `json:"name"`
 	Size int    `json:"size"`
 	Perm int    `json:"perm"`
+	// Archive means the bytes are a tar, optionally gzip or zstd compressed, or zip of the app files
+	Archive bool `json:"archive,omitempty"`
+	// Hash is the hex sha256 of the contents, checked by the server, blobs of an incremental upload have only a Hash.
+	// The empty FileMessage ending an upload has the Digest of all files in Hash.
+	Hash string `json:"hash,omitempty"`
+	// Offset is where the data of a blob starts, when resuming an upload, Size is still the size of the whole file
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// Manifest lists all files of an incremental upload, sent after the Accept, replied to with Missing
+type Manifest struct {
+	Files  []ManifestFile `json:"files"`
+	Digest string         `json:"digest"` // Digest of Files
+}
+
+// ManifestFile is a file, or a directory if Name ends with "/", with the hex sha256 of its contents in Hash
+type ManifestFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Perm int    `json:"perm"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// Missing lists the hashes of the files the server does not have, the client sends them as FileMessages with a Hash,
+// ending with an empty FileMessage
+type Missing struct {
+	Hashes []string `json:"hashes"`
+	// Partial has the bytes the server already has of some missing hashes, from an interrupted upload, the client
+	// continues at that offset
+	Partial map[string]int64 `json:"partial,omitempty"`
+}
+
+// DiffManifests returns the names of the files of to that are not in from, the files of from not in to, and the files
+// in both with a different hash, directories are left out
+func DiffManifests(from, to Manifest) (added, removed, changed []string) {
+	files := map[string]ManifestFile{}
+	for _, file := range from.Files {
+		if !EndsWith(file.Name, "/") {
+			files[strings.TrimPrefix(file.Name, "/")] = file
+		}
+	}
+	added, removed, changed = []string{}, []string{}, []string{}
+	for _, file := range to.Files {
+		name := strings.TrimPrefix(file.Name, "/")
+		if EndsWith(name, "/") {
+			continue
+		}
+		old, ok := files[name]
+		if !ok {
+			added = append(added, name)
+			continue
+		}
+		delete(files, name)
+		if old.Hash != file.Hash {
+			changed = append(changed, name)
+		}
+	}
+	for name := range files {
+		removed = append(removed, name)
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return
+}
+
+// Digest returns the hex sha256 of the names and hashes of all files, sorted by name, directories are left out, so
+// client and server can check exactly the same files were deployed
+func Digest(files []ManifestFile) string {
+	lines := []string{}
+	for _, file := range files {
+		if !EndsWith(file.Name, "/") {
+			lines = append(lines, strings.TrimPrefix(file.Name, "/")+"\x00"+file.Hash+"\n")
+		}
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(line))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashFile returns the hex sha256 of the contents of file
+func HashFile(file string) (string, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ParseTime accepts a duration like 10m meaning that long ago, or a RFC3339 time, empty is the zero time
+func ParseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// CheckHash checks hash is a hex encoded sha256
+func CheckHash(hash string) error {
+	if len(hash) != 2*sha256.Size {
+		return fmt.Errorf("bad hash: %q", hash)
+	}
+	for _, c := range hash {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
+			return fmt.Errorf("bad hash: %q", hash)
+		}
+	}
+	return nil
 }
 
 // Status ...
 type Status struct {
 	Ok  bool   `json:"status"`
 	Msg string `json:"msg"`
+	// Digest of the files of an upload, checked by the server before the app is activated
+	Digest string `json:"digest,omitempty"`
+	// Version an upload was activated as, the version in the Accept can be taken by another deploy in the meantime
+	Version int `json:"version,omitempty"`
+}
+
+// ReservedEnv are the environment variables the server sets for every app, apps cannot override them
+var ReservedEnv = []string{"PATH", "HOME", "LANG", "PORT"}
+
+// ReservedEnvPrefix is the prefix of environment variables with app metadata, like LAMBDAROACH_APP
+const ReservedEnvPrefix = "LAMBDAROACH_"
+
+// EnvName returns the KEY part of a KEY=VALUE environment entry
+func EnvName(entry string) string {
+	at := strings.Index(entry, "=")
+	if at < 0 {
+		return entry
+	}
+	return entry[:at]
+}
+
+// IsReservedEnv checks if name is set by the server and cannot be set by apps
+func IsReservedEnv(name string) bool {
+	for _, r := range ReservedEnv {
+		if name == r {
+			return true
+		}
+	}
+	return StartsWith(name, ReservedEnvPrefix)
+}
+
+// CheckEnvName checks if name is a valid environment variable name that apps may set
+func CheckEnvName(name string) error {
+	if name == "" {
+		return errors.New("empty environment variable name")
+	}
+	for i, c := range name {
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return fmt.Errorf("bad environment variable name: %q", name)
+	}
+	if IsReservedEnv(name) {
+		return fmt.Errorf("environment variable is reserved: %s", name)
+	}
+	return nil
+}
+
+// CheckEnv checks all entries are well formed KEY=VALUE and don't override reserved names
+func CheckEnv(env []string) error {
+	for _, entry := range env {
+		if !strings.Contains(entry, "=") {
+			return fmt.Errorf("environment entry is not KEY=VALUE: %q", EnvName(entry))
+		}
+		if err := CheckEnvName(EnvName(entry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckHost checks host is a valid hostname, or a wildcard like *.example.com matching all names ending in
+// .example.com, at any depth
+func CheckHost(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || len(name) > 253 || !strings.Contains(name, ".") && name != host {
+		return errors.New("bad hostname: " + host)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("bad hostname: " + host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return errors.New("bad hostname: " + host)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckPath checks prefix is a clean path like /api, without a trailing slash, to route requests to an app
+func CheckPath(prefix string) error {
+	if !StartsWith(prefix, "/") || path.Clean(prefix) != prefix {
+		return errors.New("bad path: " + prefix)
+	}
+	for _, c := range prefix {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("/-._~", c)) {
+			return errors.New("bad path: " + prefix)
+		}
+	}
+	return nil
 }
 
 // StartsWith check if string s starts with string prefix
@@ -58,17 +502,25 @@ func EndsWith(s, postfix string) bool {
 	return s[sn-pn:sn] == postfix
 }
 
-// ReadJSON0 reads upto and including \0 from the reader and uses encoding/json.Unmarshal
+// ReadJSON0 reads upto and including \0 from the reader and uses encoding/json.Unmarshal, messages larger than
+// MaxMessageSize are an error
 func ReadJSON0(in *bufio.Reader, v interface{}) error {
-	bytes, err := in.ReadBytes(byte(0))
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(bytes[:len(bytes)-1], v)
-	if err != nil {
-		return err
+	var bytes []byte
+	for {
+		chunk, err := in.ReadSlice(byte(0))
+		if len(bytes)+len(chunk) > MaxMessageSize+1 {
+			return ErrTooLarge
+		}
+		bytes = append(bytes, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
 	}
-	return nil
+	return json.Unmarshal(bytes[:len(bytes)-1], v)
 }
 
 // WriteJSON0 using encoding/json.Marshal writes the json and \0 to the Writer
@@ -77,18 +529,8 @@ func WriteJSON0(out io.Writer, v interface{}) error {
 	if err != nil {
 		return err
 	}
-	written, err := out.Write(bytes)
-	if err != nil {
-		return err
-	}
-	if written != len(bytes) {
-		log.Fatal("didn't write everything")
-	}
-	_, err = out.Write([]byte{0})
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err = out.Write(append(bytes, 0))
+	return err
 }
 
 // Copy is same as io.Copy but, does not do dst.WriteFrom(src), but returns both writer errors and reader errors
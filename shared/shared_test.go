@@ -1,7 +1,15 @@
 package shared
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
 	"testing"
+	"time"
 )
 
 func TestStartsWith(t *testing.T) {
@@ -39,3 +47,706 @@ func TestEndsWith(t *testing.T) {
 		t.Fatal("oeps")
 	}
 }
+
+func TestCheckEnv(t *testing.T) {
+	if err := CheckEnv([]string{"NODE_ENV=production", "EMPTY=", "A1=b=c"}); err != nil {
+		t.Fatal("oeps: ", err)
+	}
+	if CheckEnv([]string{"NODE_ENV"}) == nil {
+		t.Fatal("oeps")
+	}
+	if CheckEnv([]string{"=foo"}) == nil {
+		t.Fatal("oeps")
+	}
+	if CheckEnv([]string{"1A=foo"}) == nil {
+		t.Fatal("oeps")
+	}
+	if CheckEnv([]string{"A-B=foo"}) == nil {
+		t.Fatal("oeps")
+	}
+	if CheckEnv([]string{"PORT=80"}) == nil {
+		t.Fatal("oeps")
+	}
+	if CheckEnv([]string{"LAMBDAROACH_APP=foo"}) == nil {
+		t.Fatal("oeps")
+	}
+}
+
+func TestConfigAppMessage(t *testing.T) {
+	email := "me@example.com"
+	config := Config{Name: "test", Hostname: "example.com", Env: []string{"A=b"}, LetsEncrypt: &email, HTTPSOnly: true}
+	app, err := config.AppMessage("1")
+	if err != nil {
+		t.Fatal("oeps: ", err)
+	}
+	if app.Name != "test" || app.Version != "1" || app.Hosts[0] != "example.com" || app.TLS || !app.HTTPSOnly {
+		t.Fatal("oeps: ", app)
+	}
+	if app.LetsEncryptEmail != email {
+		t.Fatal("oeps: ", app)
+	}
+
+	cert := "cert.pem"
+	config.Certificate = &cert
+	config.PrivateKey = &cert
+	if _, err := config.AppMessage("1"); err == nil {
+		t.Fatal("oeps")
+	}
+	config.LetsEncrypt = nil
+	app, err = config.AppMessage("1")
+	if err != nil || !app.TLS {
+		t.Fatal("oeps: ", err)
+	}
+	config.Env = []string{"PORT=80"}
+	if _, err := config.AppMessage("1"); err == nil {
+		t.Fatal("oeps")
+	}
+}
+
+func TestCheckHash(t *testing.T) {
+	if CheckHash("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855") != nil {
+		t.Fatal("oeps")
+	}
+	if CheckHash("E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855") == nil {
+		t.Fatal("oeps")
+	}
+	if CheckHash("../../etc/passwd") == nil {
+		t.Fatal("oeps")
+	}
+	if CheckHash("") == nil {
+		t.Fatal("oeps")
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	file := path.Join(t.TempDir(), "empty")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := HashFile(file); err != nil || hash != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Fatal("oeps", hash, err)
+	}
+	if _, err := HashFile(file + "x"); err == nil {
+		t.Fatal("oeps")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	if tm, err := ParseTime(""); err != nil || !tm.IsZero() {
+		t.Fatal("oeps", tm, err)
+	}
+	if tm, err := ParseTime("10m"); err != nil || time.Since(tm) < 10*time.Minute || time.Since(tm) > 11*time.Minute {
+		t.Fatal("oeps", tm, err)
+	}
+	if tm, err := ParseTime("2020-01-02T03:04:05Z"); err != nil || !tm.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatal("oeps", tm, err)
+	}
+	if _, err := ParseTime("yesterday"); err == nil {
+		t.Fatal("oeps")
+	}
+}
+
+func TestDigest(t *testing.T) {
+	a := ManifestFile{Name: "a.txt", Hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}
+	b := ManifestFile{Name: "sub/b.txt", Hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}
+	dir := ManifestFile{Name: "sub/"}
+	digest := Digest([]ManifestFile{a, dir, b})
+	if CheckHash(digest) != nil {
+		t.Fatal("oeps: ", digest)
+	}
+	if Digest([]ManifestFile{b, a}) != digest {
+		t.Fatal("oeps: order matters")
+	}
+	b.Name = "/sub/b.txt"
+	if Digest([]ManifestFile{a, b}) != digest {
+		t.Fatal("oeps: leading slash matters")
+	}
+	b.Name = "sub/c.txt"
+	if Digest([]ManifestFile{a, b}) == digest {
+		t.Fatal("oeps: name does not matter")
+	}
+	if Digest([]ManifestFile{a}) == digest {
+		t.Fatal("oeps: missing file does not matter")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	hello := NewHello()
+	res, err := Negotiate(hello, hello)
+	if err != nil || res.Protocol != ProtocolVersion || len(res.Capabilities) != len(hello.Capabilities) {
+		t.Fatal("oeps: ", res, err)
+	}
+	if res.Auth[0] != AuthLocal || !res.Has(CapIncremental) {
+		t.Fatal("oeps: ", res)
+	}
+
+	// an older peer, without some capabilities
+	old := Hello{Op: OpHello, Protocol: 2, MinProtocol: 1, Capabilities: []string{CapArchive}, Auth: []string{AuthLocal}}
+	res, err = Negotiate(hello, old)
+	if err != nil || res.Protocol != 2 || res.Has(CapIncremental) || !res.Has(CapArchive) {
+		t.Fatal("oeps: ", res, err)
+	}
+
+	// a newer peer, that still talks our protocol, with unknown capabilities and auth methods
+	newer := Hello{Op: OpHello, Protocol: ProtocolVersion + 5, MinProtocol: ProtocolVersion, Capabilities: []string{"teleport", CapDigest}, Auth: []string{"magic", AuthLocal}}
+	res, err = Negotiate(hello, newer)
+	if err != nil || res.Protocol != ProtocolVersion || len(res.Capabilities) != 1 || !res.Has(CapDigest) || res.Auth[0] != AuthLocal {
+		t.Fatal("oeps: ", res, err)
+	}
+
+	// a newer peer that dropped our protocol
+	newer.MinProtocol = ProtocolVersion + 1
+	if _, err := Negotiate(hello, newer); err == nil {
+		t.Fatal("oeps")
+	}
+	if _, err := Negotiate(newer, hello); err == nil {
+		t.Fatal("oeps")
+	}
+
+	// no common auth
+	old.Auth = []string{"token"}
+	if _, err := Negotiate(hello, old); err == nil {
+		t.Fatal("oeps")
+	}
+}
+
+func TestCompatibleMessages(t *testing.T) {
+	// messages of older peers, without the newer fields
+	var app AppMessage
+	if err := json.Unmarshal([]byte(`{"name":"test","version":"1","command":"","hosts":["example.com"],"env":null,"tls":false,"letsencryptmail":"","httpsonly":false}`), &app); err != nil {
+		t.Fatal("oeps: ", err)
+	}
+	if app.Name != "test" || app.Incremental {
+		t.Fatal("oeps: ", app)
+	}
+	var accept Accept
+	if err := json.Unmarshal([]byte(`{"version":3,"id":"abc"}`), &accept); err != nil || accept.Incremental || accept.Version != 3 {
+		t.Fatal("oeps: ", accept, err)
+	}
+	var file FileMessage
+	if err := json.Unmarshal([]byte(`{"name":"index.html","size":10,"perm":0}`), &file); err != nil || file.Hash != "" || file.Archive {
+		t.Fatal("oeps: ", file, err)
+	}
+
+	// messages of newer peers, with unknown fields
+	var hello Hello
+	if err := json.Unmarshal([]byte(`{"op":"hello","protocol":9,"minprotocol":2,"capabilities":["x"],"auth":["local"],"future":true}`), &hello); err != nil || hello.Protocol != 9 {
+		t.Fatal("oeps: ", hello, err)
+	}
+
+	// an old server replies to a hello with an error status, the first servers without ops even with an Accept
+	var status Status
+	if err := json.Unmarshal([]byte(`{"status":false,"msg":"unknown op: hello"}`), &status); err != nil || status.Ok {
+		t.Fatal("oeps: ", status, err)
+	}
+	if err := json.Unmarshal([]byte(`{"version":1,"id":"abc"}`), &status); err != nil || status.Ok {
+		t.Fatal("oeps: ", status, err)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	out := NewConn(bufio.NewReader(&buf), &buf)
+	out.SetFramed()
+	data := bytes.Repeat([]byte("lambdaroach"), 20000)
+	if err := out.WriteJSON(FileMessage{Name: "a.txt", Size: len(data)}); err != nil {
+		t.Fatal("oeps: ", err)
+	}
+	if n, err := out.Write(data); err != nil || n != len(data) {
+		t.Fatal("oeps: ", n, err)
+	}
+	if err := out.WriteJSON(FileMessage{}); err != nil {
+		t.Fatal("oeps: ", err)
+	}
+
+	in := NewConn(bufio.NewReader(&buf), ioutil.Discard)
+	in.SetFramed()
+	var file FileMessage
+	if err := in.ReadJSON(&file); err != nil || file.Name != "a.txt" {
+		t.Fatal("oeps: ", file, err)
+	}
+	read, err := ioutil.ReadAll(in.Data(int64(file.Size)))
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatal("oeps: ", len(read), err)
+	}
+	if err := in.ReadJSON(&file); err != nil || file.Name != "" {
+		t.Fatal("oeps: ", file, err)
+	}
+
+	// a data frame where a message is expected
+	WriteFrame(&buf, FrameData, []byte("{}"))
+	if err := in.ReadJSON(&file); err == nil {
+		t.Fatal("oeps")
+	}
+	// more data than announced
+	WriteFrame(&buf, FrameData, []byte("1234"))
+	if _, err := ioutil.ReadAll(in.Data(2)); err == nil {
+		t.Fatal("oeps")
+	}
+	// a frame larger than the maximum is refused before reading it
+	buf.Reset()
+	buf.Write([]byte{FrameJSON, 0xff, 0xff, 0xff, 0xff})
+	if err := in.ReadJSON(&file); err != ErrTooLarge {
+		t.Fatal("oeps: ", err)
+	}
+	// truncated
+	buf.Reset()
+	buf.Write([]byte{FrameJSON, 0, 0, 0, 10, '{'})
+	if err := in.ReadJSON(&file); err != io.ErrUnexpectedEOF {
+		t.Fatal("oeps: ", err)
+	}
+}
+
+func TestReadJSON0(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJSON0(&buf, Status{Ok: true, Msg: "hi"}); err != nil {
+		t.Fatal("oeps: ", err)
+	}
+	var status Status
+	if err := ReadJSON0(bufio.NewReader(&buf), &status); err != nil || !status.Ok || status.Msg != "hi" {
+		t.Fatal("oeps: ", status, err)
+	}
+
+	// without a NUL within the maximum size, the message is refused, instead of read into memory
+	big := bufio.NewReader(io.LimitReader(zeroless{}, 2*MaxMessageSize))
+	if err := ReadJSON0(big, &status); err != ErrTooLarge {
+		t.Fatal("oeps: ", err)
+	}
+}
+
+// zeroless is an endless stream without NUL bytes
+type zeroless struct{}
+
+func (zeroless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func FuzzReadFrame(f *testing.F) {
+	var buf bytes.Buffer
+	WriteFrame(&buf, FrameJSON, []byte(`{"name":"a.txt","size":3}`))
+	WriteFrame(&buf, FrameData, []byte("abc"))
+	f.Add(buf.Bytes())
+	f.Add([]byte{FrameJSON, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{FrameData, 0, 0, 0, 0})
+	buf.Reset()
+	for _, kind := range []byte{FrameGzip, FrameZstd} {
+		compressed, _ := compress(kind, bytes.Repeat([]byte("abc"), 1000))
+		WriteFrame(&buf, kind, compressed)
+	}
+	f.Add(buf.Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for {
+			kind, payload, err := ReadFrame(r, MaxDataFrame)
+			if err != nil {
+				return
+			}
+			switch kind {
+			case FrameJSON, FrameData, FrameGzip, FrameZstd:
+			default:
+				t.Fatal("oeps: ", kind, len(payload))
+			}
+			if len(payload) > MaxDataFrame {
+				t.Fatal("oeps: ", kind, len(payload))
+			}
+			if data, err := decompress(kind, payload); err == nil && len(data) > MaxDataFrame {
+				t.Fatal("oeps: ", kind, len(data))
+			}
+		}
+	})
+}
+
+func FuzzConn(f *testing.F) {
+	var buf bytes.Buffer
+	c := NewConn(bufio.NewReader(&buf), &buf)
+	c.SetFramed()
+	c.WriteJSON(FileMessage{Name: "a.txt", Size: 3})
+	c.Write([]byte("abc"))
+	c.WriteJSON(FileMessage{})
+	f.Add(buf.Bytes(), true)
+	buf.Reset()
+	c.SetCompression(NewHello())
+	c.WriteJSON(FileMessage{Name: "a.txt", Size: 3000})
+	c.Write(bytes.Repeat([]byte("abc"), 1000))
+	f.Add(buf.Bytes(), true)
+	f.Add([]byte(`{"name":"a.txt","size":3}`+"\x00abc{}\x00"), false)
+	f.Fuzz(func(t *testing.T, data []byte, framed bool) {
+		c := NewConn(bufio.NewReader(bytes.NewReader(data)), ioutil.Discard)
+		if framed {
+			c.SetFramed()
+		}
+		for {
+			var file FileMessage
+			if err := c.ReadJSON(&file); err != nil {
+				return
+			}
+			if file.Size < 0 || file.Size > MaxDataFrame {
+				return
+			}
+			read, err := ioutil.ReadAll(c.Data(int64(file.Size)))
+			if len(read) > file.Size {
+				t.Fatal("oeps: read more than announced")
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestCompressedFrames(t *testing.T) {
+	data := bytes.Repeat([]byte("compress me "), 30000)
+	for _, capability := range []string{CapZstd, CapGzip} {
+		var buf bytes.Buffer
+		out := NewConn(bufio.NewReader(&buf), &buf)
+		out.SetFramed()
+		if out.SetCompression(Hello{Capabilities: []string{"other", capability}}) != capability {
+			t.Fatal("oeps: ", capability)
+		}
+		if _, err := out.Write(data); err != nil {
+			t.Fatal("oeps: ", err)
+		}
+		written, sent := out.DataCounts()
+		if written != int64(len(data)) || sent >= written/10 || int64(buf.Len()) != sent {
+			t.Fatal("oeps: ", capability, written, sent)
+		}
+
+		in := NewConn(bufio.NewReader(&buf), ioutil.Discard)
+		in.SetFramed()
+		read, err := ioutil.ReadAll(in.Data(int64(len(data))))
+		if err != nil || !bytes.Equal(read, data) {
+			t.Fatal("oeps: ", capability, len(read), err)
+		}
+	}
+
+	// frames decompressing to more than MaxDataFrame are refused
+	for _, kind := range []byte{FrameZstd, FrameGzip} {
+		bomb, err := compress(kind, make([]byte, 10*MaxDataFrame))
+		if err != nil {
+			t.Fatal("oeps: ", err)
+		}
+		if _, err := decompress(kind, bomb); err == nil {
+			t.Fatal("oeps: ", kind)
+		}
+
+		// also when read as a frame, the compressed frame itself is small
+		var buf bytes.Buffer
+		small, _ := compress(kind, []byte("small"))
+		WriteFrame(&buf, kind, small)
+		WriteFrame(&buf, kind, bomb)
+		read, payload, err := ReadFrame(bytes.NewReader(buf.Bytes()), MaxDataFrame)
+		if err != nil || read != kind || !bytes.Equal(payload, small) {
+			t.Fatal("oeps: ", kind, err)
+		}
+		in := NewConn(bufio.NewReader(&buf), ioutil.Discard)
+		in.SetFramed()
+		data, err := ioutil.ReadAll(in.Data(20 * MaxDataFrame))
+		if err == nil || string(data) != "small" {
+			t.Fatal("oeps: ", kind, len(data), err)
+		}
+	}
+
+	var none Conn
+	if none.SetCompression(Hello{Capabilities: []string{CapDigest}}) != "" {
+		t.Fatal("oeps")
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	ignore, err := ParseIgnore("", []string{
+		"# comment",
+		"",
+		"node_modules/",
+		"*.log",
+		"!keep.log",
+		"/build",
+		"docs/**/*.tmp",
+		"cache/**",
+		"!cache/readme",
+		"\\#notes",
+	})
+	if err != nil {
+		t.Fatal("oeps")
+	}
+	tests := []struct {
+		name    string
+		isdir   bool
+		ignored bool
+	}{
+		{"node_modules", true, true},
+		{"src/node_modules", true, true},
+		{"node_modules", false, false},
+		{"error.log", false, true},
+		{"logs/debug.log", false, true},
+		{"keep.log", false, false},
+		{"logs/keep.log", false, false},
+		{"build", true, true},
+		{"src/build", true, false},
+		{"docs/a.tmp", false, true},
+		{"docs/x/y/a.tmp", false, true},
+		{"a.tmp", false, false},
+		{"cache", true, false},
+		{"cache/data", false, true},
+		{"cache/readme", false, false},
+		{"#notes", false, true},
+		{"main.go", false, false},
+	}
+	for _, test := range tests {
+		if ignore.Match(test.name, test.isdir) != test.ignored {
+			t.Fatal("oeps", test.name)
+		}
+	}
+
+	nested, err := ParseIgnore("src", []string{"/gen", "*.o"})
+	if err != nil {
+		t.Fatal("oeps")
+	}
+	if !nested.Match("src/gen", true) || nested.Match("gen", true) || nested.Match("src/x/gen", true) {
+		t.Fatal("oeps")
+	}
+	if !nested.Match("src/x/a.o", false) || nested.Match("a.o", false) {
+		t.Fatal("oeps")
+	}
+
+	if _, err := ParseIgnore("", []string{"[a"}); err == nil {
+		t.Fatal("oeps")
+	}
+
+	config := Config{Exclude: []string{"*.test"}, Include: []string{".well-known/", "keep.test"}}
+	rules, err := config.Ignore()
+	if err != nil {
+		t.Fatal("oeps")
+	}
+	hidden, _ := ParseIgnore("", []string{".*"})
+	rules = append(hidden, rules...)
+	if !rules.Match(".env", false) || rules.Match(".well-known", true) {
+		t.Fatal("oeps")
+	}
+	if !rules.Match("a.test", false) || rules.Match("keep.test", false) {
+		t.Fatal("oeps")
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	from := Manifest{Files: []ManifestFile{
+		{Name: "/a", Hash: "1"},
+		{Name: "/b", Hash: "2"},
+		{Name: "/c", Hash: "3"},
+		{Name: "/dir/"},
+	}}
+	to := Manifest{Files: []ManifestFile{
+		{Name: "a", Hash: "1"},
+		{Name: "c", Hash: "4"},
+		{Name: "d", Hash: "5"},
+		{Name: "other/"},
+	}}
+	added, removed, changed := DiffManifests(from, to)
+	if len(added) != 1 || added[0] != "d" {
+		t.Fatal("oeps")
+	}
+	if len(removed) != 1 || removed[0] != "b" {
+		t.Fatal("oeps")
+	}
+	if len(changed) != 1 || changed[0] != "c" {
+		t.Fatal("oeps")
+	}
+	added, removed, changed = DiffManifests(to, to)
+	if len(added)+len(removed)+len(changed) != 0 {
+		t.Fatal("oeps")
+	}
+}
+
+func TestHosts(t *testing.T) {
+	for _, host := range []string{"example.com", "www.example.com", "*.example.com", "localhost", "a-b.example.com"} {
+		if CheckHost(host) != nil {
+			t.Fatal("oeps", host)
+		}
+	}
+	for _, host := range []string{"", "*", "*.com", "a.*.example.com", "-a.example.com", "a..com", "a_b.com", "example.com:80"} {
+		if CheckHost(host) == nil {
+			t.Fatal("oeps", host)
+		}
+	}
+
+	config := Config{Name: "test", Hostname: "Example.com", Hostnames: []string{"www.example.com", "example.com", "*.example.com"}}
+	app, err := config.AppMessage("1")
+	if err != nil {
+		t.Fatal("oeps: ", err)
+	}
+	if len(app.Hosts) != 3 || app.Hosts[0] != "example.com" || app.Hosts[1] != "www.example.com" || app.Hosts[2] != "*.example.com" {
+		t.Fatal("oeps: ", app.Hosts)
+	}
+	config.Hostname = ""
+	if hosts := config.Hosts(); len(hosts) != 3 || hosts[0] != "www.example.com" {
+		t.Fatal("oeps: ", hosts)
+	}
+	config.Hostnames = []string{"bad host"}
+	if _, err := config.AppMessage("1"); err == nil {
+		t.Fatal("oeps")
+	}
+}
+
+func TestCleanHosts(t *testing.T) {
+	hosts := CleanHosts([]string{"Example.COM", "example.com.", "*.Example.com", ""})
+	if len(hosts) != 3 || hosts[0] != "example.com" || hosts[1] != "*.example.com" || hosts[2] != "" {
+		t.Fatal("oeps", hosts)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	for _, prefix := range []string{"/", "/api", "/api/v1", "/a-b_c.d~"} {
+		if CheckPath(prefix) != nil {
+			t.Fatal("oeps", prefix)
+		}
+	}
+	for _, prefix := range []string{"", "api", "/api/", "/api/../etc", "//api", "/a b", "/api?x"} {
+		if CheckPath(prefix) == nil {
+			t.Fatal("oeps", prefix)
+		}
+	}
+
+	config := Config{Name: "test", Hostname: "example.com", Paths: []string{"/api/", "/"}, StripPath: true}
+	app, err := config.AppMessage("1")
+	if err != nil {
+		t.Fatal("oeps: ", err)
+	}
+	if len(app.Paths) != 2 || app.Paths[0] != "/api" || app.Paths[1] != "/" || !app.StripPath {
+		t.Fatal("oeps: ", app.Paths)
+	}
+	config.Paths = []string{"api"}
+	if _, err := config.AppMessage("1"); err == nil {
+		t.Fatal("oeps")
+	}
+}
+
+func TestRules(t *testing.T) {
+	if to, ok := MatchRule("/old", "/new", "/old"); !ok || to != "/new" {
+		t.Fatal("oeps")
+	}
+	if _, ok := MatchRule("/old", "/new", "/old/x"); ok {
+		t.Fatal("oeps")
+	}
+	if to, ok := MatchRule("/blog/*", "https://blog.example.com/*", "/blog/2020/post"); !ok || to != "https://blog.example.com/2020/post" {
+		t.Fatal("oeps", to)
+	}
+	if to, ok := MatchRule("/app*", "/index.html", "/app/x"); !ok || to != "/index.html" {
+		t.Fatal("oeps", to)
+	}
+	if to, ok := MatchRule("/old/*", "/new/*", "/old//a///b"); !ok || to != "/new/a/b" {
+		t.Fatal("oeps", to)
+	}
+	// the rest of the path cannot make a path redirect go to another host
+	for _, path := range []string{"/old//evil.example", "/old///evil.example"} {
+		if to, ok := MatchRule("/old/*", "/*", path); !ok || to != "/evil.example" {
+			t.Fatal("oeps", path, to)
+		}
+	}
+	if to, ok := MatchRule("/old*", "*", "/old//evil.example"); !ok || to != "/evil.example" {
+		t.Fatal("oeps", to)
+	}
+	if to, ok := MatchRule("/old/*", "/*", "/old/\\evil.example"); ok {
+		t.Fatal("oeps", to)
+	}
+	if to, ok := MatchRule("/old/*", "/*", "/old/new"); !ok || to != "/new" {
+		t.Fatal("oeps", to)
+	}
+	if to, ok := MatchRule("/cdn/*", "//cdn.example.com/*", "/cdn/a.js"); !ok || to != "//cdn.example.com/a.js" {
+		t.Fatal("oeps", to)
+	}
+
+	rules := Rules{
+		CanonicalHost:   "example.com",
+		Redirects:       []Redirect{{From: "/old", To: "/new", Status: 302}},
+		Rewrites:        []Rewrite{{From: "/app/*", To: "/index.html"}},
+		RequestHeaders:  HeaderRules{Set: map[string]string{"X-App": "1"}, Remove: []string{"Cookie"}},
+		ResponseHeaders: HeaderRules{Set: map[string]string{"X-Frame-Options": "DENY"}, Remove: []string{"Server"}},
+	}
+	if err := rules.Check(); err != nil {
+		t.Fatal("oeps", err)
+	}
+	h := http.Header{"Server": {"app"}}
+	rules.ResponseHeaders.Apply(h)
+	if h.Get("Server") != "" || h.Get("X-Frame-Options") != "DENY" {
+		t.Fatal("oeps")
+	}
+
+	bad := []Rules{
+		{CanonicalHost: "*.example.com"},
+		{Redirects: []Redirect{{From: "old", To: "/new"}}},
+		{Redirects: []Redirect{{From: "/old", To: "/new", Status: 200}}},
+		{Rewrites: []Rewrite{{From: "/a", To: "http://example.com/"}}},
+		{Redirects: []Redirect{{From: "/a*", To: "https://example.com*"}}},
+		{Redirects: []Redirect{{From: "/a*", To: "https://example.com?q=*"}}},
+		{RequestHeaders: HeaderRules{Set: map[string]string{"Host": "evil.com"}}},
+		{ResponseHeaders: HeaderRules{Set: map[string]string{"X-A": "a\r\nSet-Cookie: x"}}},
+		{ResponseHeaders: HeaderRules{Remove: []string{"bad header"}}},
+	}
+	for _, rules := range bad {
+		if rules.Check() == nil {
+			t.Fatal("oeps", rules)
+		}
+	}
+}
+
+func TestStatic(t *testing.T) {
+	static := Static{}
+	if indexes := static.Indexes(); len(indexes) != 1 || indexes[0] != "index.html" {
+		t.Fatal("oeps")
+	}
+	static = Static{
+		Index:    []string{"index.htm", "default.html"},
+		NotFound: "/404.html",
+		Cache:    []CacheRule{{Path: "/assets/**", Control: "max-age=31536000, immutable"}, {Path: "*.html", Control: "no-cache"}},
+	}
+	if err := static.Check(); err != nil || static.Indexes()[0] != "index.htm" {
+		t.Fatal("oeps", err)
+	}
+	bad := []Static{
+		{Index: []string{"a/index.html"}},
+		{Index: []string{".index"}},
+		{NotFound: "404.html"},
+		{NotFound: "/.secret"},
+		{Cache: []CacheRule{{Path: "[x", Control: "no-cache"}}},
+		{Cache: []CacheRule{{Path: "", Control: "no-cache"}}},
+		{Cache: []CacheRule{{Path: "*", Control: "no-cache\r\nSet-Cookie: a"}}},
+	}
+	for _, static := range bad {
+		if static.Check() == nil {
+			t.Fatal("oeps", static)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	compress := Compress{}
+	if pref := compress.Preference(); len(pref) != 2 || pref[0] != "br" || compress.Threshold() != 1024 {
+		t.Fatal("oeps")
+	}
+	if !compress.Compressible("text/html; charset=utf-8") || !compress.Compressible("application/ld+json") {
+		t.Fatal("oeps")
+	}
+	if compress.Compressible("image/png") || compress.Compressible("") {
+		t.Fatal("oeps")
+	}
+	compress = Compress{Encodings: []string{"gzip"}, MinSize: 10, Types: []string{"text/plain"}}
+	if err := compress.Check(); err != nil || compress.Preference()[0] != "gzip" || compress.Threshold() != 10 {
+		t.Fatal("oeps", err)
+	}
+	if compress.Compressible("text/html") || !compress.Compressible("Text/Plain") {
+		t.Fatal("oeps")
+	}
+	bad := []Compress{
+		{Encodings: []string{"deflate"}},
+		{MinSize: -1},
+		{Types: []string{"[x"}},
+		{Types: []string{""}},
+	}
+	for _, compress := range bad {
+		if compress.Check() == nil {
+			t.Fatal("oeps", compress)
+		}
+	}
+}